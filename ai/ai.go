@@ -1,17 +1,35 @@
 package ai
 
 import (
+	"bufio"
 	"bytes"
 	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"iter"
+	"math"
 	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/niklasfasching/x/ops"
 )
 
 type Client struct {
 	URL, Key, Model string
+	Provider        // defaults to Anthropic
+	HTTP            *http.Client
+}
+
+// Provider translates a Chat to and from the wire format of an API
+type Provider interface {
+	Send(context.Context, *Chat) (*Response, error)
+	// Stream calls f with text deltas and completed tool_use blocks.
+	// It returns a nil Response without error if f returns false.
+	Stream(context.Context, *Chat, func(Block) bool) (*Response, error)
 }
 
 type Chat struct {
@@ -21,6 +39,37 @@ type Chat struct {
 	MaxTokens   int
 	Temperature float64
 	Tools       []Tool
+	ToolChoice  string // "" lets the model decide, "any" forces some tool, anything else the named tool
+	Streaming   bool
+	Usage       Usage // cumulative usage of all responses
+	Budget      int   // max total tokens for Loop; 0 is unlimited
+	Concurrency int   // max tool calls run in parallel per turn; <= 1 runs them sequentially
+	Compaction  *Compaction
+	CacheSystem bool // mark System (and Tools) as a cache breakpoint
+	OnResponse  func(*Response)
+}
+
+type Response struct {
+	ID         string  `json:"id"`
+	Model      string  `json:"model"`
+	Content    []Block `json:"content"`
+	StopReason string  `json:"stop_reason"`
+	Usage      Usage   `json:"usage"`
+}
+
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+}
+
+// Price per million tokens
+type Price struct{ Input, Output, CacheWrite, CacheRead float64 }
+
+type BudgetError struct {
+	Budget int
+	Usage  Usage
 }
 
 type Message struct {
@@ -34,15 +83,56 @@ type Tool struct {
 	Name        string          `json:"name"`
 	Description string          `json:"description"`
 	Schema      json.RawMessage `json:"input_schema"`
+	Timeout     time.Duration   `json:"-"`
 	Handler     `json:"-"`
 }
 
 type Block struct {
-	Type  string          `json:"type"`
-	Text  string          `json:"text,omitempty"`
-	ID    string          `json:"id,omitempty"`
-	Name  string          `json:"name,omitempty"`
-	Input json.RawMessage `json:"input,omitempty"`
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   any             `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+	Source    *Source         `json:"source,omitempty"`
+	Title     string          `json:"title,omitempty"`
+	Cache     *CacheControl   `json:"cache_control,omitempty"`
+}
+
+// Source is the content of an image or document block
+type Source struct {
+	Type      string `json:"type"` // base64, url or text
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// CacheControl marks a cache breakpoint: the prompt up to and including the block is cached
+type CacheControl struct {
+	Type string `json:"type"`
+	TTL  string `json:"ttl,omitempty"`
+}
+
+// UnmarshalJSON decodes Content as either a string or []Block
+func (m *Message) UnmarshalJSON(bs []byte) error {
+	r := struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}{}
+	if err := json.Unmarshal(bs, &r); err != nil {
+		return err
+	}
+	m.Role = r.Role
+	if s := ""; json.Unmarshal(r.Content, &s) == nil {
+		m.Content = s
+		return nil
+	}
+	blks := []Block{}
+	err := json.Unmarshal(r.Content, &blks)
+	m.Content = blks
+	return err
 }
 
 func NewChat(c *Client, system string, tools []Tool, userMsgs ...string) *Chat {
@@ -53,84 +143,275 @@ func NewChat(c *Client, system string, tools []Tool, userMsgs ...string) *Chat {
 	return &Chat{Client: c, System: system, Tools: tools, Messages: ms, MaxTokens: 4096}
 }
 
-func (ch *Chat) Send(ctx context.Context, input any) ([]Block, error) {
+func (ch *Chat) Send(ctx context.Context, input any) (*Response, error) {
+	if input != nil {
+		ch.Messages = append(ch.Messages, Message{Role: "user", Content: input})
+	}
+	r, err := ch.provider().Send(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+	ch.Messages = append(ch.Messages, Message{Role: "assistant", Content: r.Content})
+	ch.record(r)
+	return r, nil
+}
+
+// Stream is like Send but yields text deltas and completed tool_use blocks as they arrive.
+// The assembled assistant message is appended to ch.Messages once the stream has completed;
+// breaking out of the loop early leaves ch.Messages as it was before the call.
+func (ch *Chat) Stream(ctx context.Context, input any) iter.Seq2[Block, error] {
+	return func(yield func(Block, error) bool) {
+		stopped := false
+		_, err := ch.stream(ctx, input, func(b Block) bool {
+			stopped = !yield(b, nil)
+			return !stopped
+		})
+		if err != nil && !stopped {
+			yield(Block{}, err)
+		}
+	}
+}
+
+func (ch *Chat) Loop(ctx context.Context, input any, n int, cb func(Block)) error {
+	for range n {
+		if err := ch.Compact(ctx); err != nil {
+			return err
+		}
+		r, err := ch.turn(ctx, input, cb)
+		if err != nil {
+			return err
+		} else if ch.Budget > 0 && ch.Usage.Total() > ch.Budget {
+			err := &BudgetError{Budget: ch.Budget, Usage: ch.Usage}
+			if rblks := skipTools(r.Content, err); len(rblks) != 0 {
+				ch.Messages = append(ch.Messages, Message{Role: "user", Content: rblks})
+			}
+			return err
+		}
+		rblks := ch.runTools(ctx, r.Content, cb)
+		if len(rblks) == 0 {
+			return nil
+		}
+		input = ch.Compaction.truncate(rblks)
+	}
+	return fmt.Errorf("max steps %d exceeded", n)
+}
+
+// skipTools returns error results for the tool calls of blks so the chat stays valid without running them
+func skipTools(blks []Block, err error) []Block {
+	rblks := []Block{}
+	for _, b := range blks {
+		if b.Type == "tool_use" {
+			rblks = append(rblks, Block{Type: "tool_result", ToolUseID: b.ID, Content: err.Error(), IsError: true})
+		}
+	}
+	return rblks
+}
+
+func (ch *Chat) runTools(ctx context.Context, blks []Block, cb func(Block)) []Block {
+	uses := slices.DeleteFunc(slices.Clone(blks), func(b Block) bool { return b.Type != "tool_use" })
+	rblks, rbs := make([]Block, len(uses)), make([]Block, len(uses))
+	if ch.Concurrency <= 1 {
+		for i, b := range uses {
+			rblks[i], rbs[i] = ch.runTool(ctx, b)
+			if cb != nil {
+				cb(rbs[i])
+			}
+		}
+		return rblks
+	}
+	wg, sem := sync.WaitGroup{}, make(chan struct{}, ch.Concurrency)
+	for i, b := range uses {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			rblks[i], rbs[i] = ch.runTool(ctx, b)
+		})
+	}
+	wg.Wait()
+	for _, rb := range rbs {
+		if cb != nil {
+			cb(rb)
+		}
+	}
+	return rblks
+}
+
+func (ch *Chat) runTool(ctx context.Context, b Block) (Block, Block) {
+	v, rb, err := "", Block{}, fmt.Errorf("tool %q not found", b.Name)
+	if i := slices.IndexFunc(ch.Tools, func(t Tool) bool { return t.Name == b.Name }); i != -1 {
+		t, cancel := ch.Tools[i], context.CancelFunc(func() {})
+		tctx := ctx
+		if t.Timeout > 0 {
+			tctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		}
+		defer cancel()
+		if err = ctx.Err(); err == nil {
+			v, rb, err = t.Handler(tctx, b.Input)
+		}
+	}
+	if err != nil {
+		v = err.Error()
+	}
+	rb.ID, rb.Type = cmp.Or(rb.ID, b.ID), cmp.Or(rb.Type, "tool")
+	rb.Name, rb.Text, rb.IsError = cmp.Or(rb.Name, b.Name), cmp.Or(rb.Text, v), err != nil
+	return Block{Type: "tool_result", ToolUseID: b.ID, Content: v, IsError: err != nil}, rb
+}
+
+func (u Usage) Total() int {
+	return u.InputTokens + u.OutputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// Cost returns the price of u in the currency of p; p is priced per million tokens
+func (u Usage) Cost(p Price) float64 {
+	return (float64(u.InputTokens)*p.Input + float64(u.OutputTokens)*p.Output +
+		float64(u.CacheCreationInputTokens)*p.CacheWrite + float64(u.CacheReadInputTokens)*p.CacheRead) / 1e6
+}
+
+func (u *Usage) Add(o Usage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("token budget exceeded: %d > %d", e.Usage.Total(), e.Budget)
+}
+
+// Metrics returns an OnResponse hook that counts tokens per app, model and kind in m,
+// as well as their cost at p in millionths of the currency of p
+func Metrics(m *ops.M, app string, p Price) func(*Response) {
+	return func(r *Response) {
+		tags := fmt.Sprintf("app=%s,model=%s", m.Esc(app, "-"), m.Esc(r.Model, "-"))
+		m.Counter("ai_cost_micros_total,"+tags, int64(math.Round(r.Usage.Cost(p)*1e6)))
+		m.Counter("ai_tokens_total,"+tags+",kind=input", int64(r.Usage.InputTokens))
+		m.Counter("ai_tokens_total,"+tags+",kind=output", int64(r.Usage.OutputTokens))
+		m.Counter("ai_tokens_total,"+tags+",kind=cache_write", int64(r.Usage.CacheCreationInputTokens))
+		m.Counter("ai_tokens_total,"+tags+",kind=cache_read", int64(r.Usage.CacheReadInputTokens))
+		m.Counter("ai_responses_total,"+tags+",stop_reason="+m.Esc(r.StopReason, "-"), 1)
+	}
+}
+
+func (ch *Chat) record(r *Response) {
+	ch.Usage.Add(r.Usage)
+	if ch.OnResponse != nil {
+		ch.OnResponse(r)
+	}
+}
+
+func (ch *Chat) turn(ctx context.Context, input any, cb func(Block)) (*Response, error) {
+	if ch.Streaming {
+		return ch.stream(ctx, input, func(b Block) bool {
+			if cb != nil {
+				cb(b)
+			}
+			return true
+		})
+	}
+	r, err := ch.Send(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range r.Content {
+		if cb != nil {
+			cb(b)
+		}
+	}
+	return r, nil
+}
+
+// stream returns a nil response without error if f stops it early; ch.Messages is then reset to
+// before the call so the chat doesn't end with an unanswered user message
+func (ch *Chat) stream(ctx context.Context, input any, f func(Block) bool) (*Response, error) {
+	n := len(ch.Messages)
 	if input != nil {
 		ch.Messages = append(ch.Messages, Message{Role: "user", Content: input})
 	}
-	body, err := json.Marshal(map[string]any{
-		"model":       ch.Model,
-		"max_tokens":  ch.MaxTokens,
-		"system":      ch.System,
-		"messages":    ch.Messages,
-		"tools":       ch.Tools,
-		"temperature": ch.Temperature,
-	})
+	r, err := ch.provider().Stream(ctx, ch, f)
+	if err != nil {
+		return nil, err
+	} else if r == nil {
+		ch.Messages = ch.Messages[:n]
+		return nil, nil
+	}
+	ch.Messages = append(ch.Messages, Message{Role: "assistant", Content: r.Content})
+	ch.record(r)
+	return r, nil
+}
+
+func (ch *Chat) provider() Provider {
+	if ch.Provider != nil {
+		return ch.Provider
+	}
+	return Anthropic{}
+}
+
+func (c *Client) post(ctx context.Context, body any, headers ...string) (*http.Response, error) {
+	bs, err := json.Marshal(body)
 	if err != nil {
 		return nil, fmt.Errorf("marshal: %w", err)
 	}
-	req, err := http.NewRequestWithContext(ctx, "POST", ch.URL, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.URL, bytes.NewReader(bs))
 	if err != nil {
 		return nil, fmt.Errorf("req: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-Api-Key", ch.Key)
-	req.Header.Set("Anthropic-Version", "2023-06-01")
-	resp, err := http.DefaultClient.Do(req)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := cmp.Or(c.HTTP, http.DefaultClient).Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("fetch: %w", err)
-	}
-	defer resp.Body.Close()
-	bs, err := io.ReadAll(resp.Body)
-	if resp.StatusCode != 200 {
+	} else if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		bs, _ := io.ReadAll(resp.Body)
 		return nil, fmt.Errorf("http %d: %s", resp.StatusCode, string(bs))
 	}
-	r := struct{ Content []Block }{}
-	if err := json.Unmarshal(bs, &r); err != nil {
-		return nil, fmt.Errorf("parse: %w", err)
+	return resp, nil
+}
+
+// blocks normalizes message content (string, []Block or equivalent json) to []Block
+func blocks(v any) []Block {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return []Block{{Type: "text", Text: v}}
+	case []Block:
+		return v
 	}
-	ch.Messages = append(ch.Messages, Message{Role: "assistant", Content: r.Content})
-	return r.Content, nil
+	bs, _ := json.Marshal(v)
+	blks := []Block{}
+	if err := json.Unmarshal(bs, &blks); err != nil {
+		return []Block{{Type: "text", Text: string(bs)}}
+	}
+	return blks
 }
 
-func (ch *Chat) Loop(ctx context.Context, input any, n int, cb func(Block)) error {
-	for range n {
-		blks, err := ch.Send(ctx, input)
-		if err != nil {
-			return err
-		}
-		rblks := []map[string]any{}
-		for _, b := range blks {
-			if cb != nil {
-				cb(b)
-			}
-			if b.Type != "tool_use" {
-				continue
-			}
-			v, rb, err := "error: tool not found", Block{}, fmt.Errorf("tool not found")
-			for _, t := range ch.Tools {
-				if t.Name == b.Name {
-					v, rb, err = t.Handler(ctx, b.Input)
-					break
+// events yields the data payloads of a server-sent event stream
+func events(r io.Reader) iter.Seq2[[]byte, error] {
+	return func(yield func([]byte, error) bool) {
+		s, data := bufio.NewScanner(r), []byte{}
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for s.Scan() {
+			if l := s.Bytes(); len(l) == 0 && len(data) != 0 {
+				if !yield(data, nil) {
+					return
 				}
+				data = []byte{}
+			} else if v, ok := bytes.CutPrefix(l, []byte("data:")); ok {
+				if len(data) != 0 {
+					data = append(data, '\n')
+				}
+				data = append(data, bytes.TrimPrefix(v, []byte(" "))...)
 			}
-			if err != nil {
-				v = "error: " + err.Error()
-			}
-			rb.ID, rb.Type = cmp.Or(rb.ID, b.ID), cmp.Or(rb.Type, "tool")
-			rb.Name, rb.Text = cmp.Or(rb.Name, b.Name), cmp.Or(rb.Text, v)
-			if cb != nil {
-				cb(rb)
-			}
-			rblks = append(rblks, map[string]any{
-				"type": "tool_result", "tool_use_id": b.ID, "content": v,
-			})
 		}
-		if len(rblks) == 0 {
-			return nil
+		if err := s.Err(); err != nil {
+			yield(nil, err)
+		} else if len(data) != 0 {
+			yield(data, nil)
 		}
-		input = rblks
 	}
-	return fmt.Errorf("max steps %d exceeded", n)
 }
 
 func MapStringArgs(ks ...string) json.RawMessage {
@@ -1,22 +1,619 @@
 package ai
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/niklasfasching/x/ops"
 )
 
+// testdata/replay holds hand-written responses in the Recording format; -record replaces them
+// with recordings of the api
+var record = flag.Bool("record", false, "record testdata/replay using AI{Key,URL,Model}")
+
 func TestAgent(t *testing.T) {
 	key, url, model := os.Getenv("AIKey"), os.Getenv("AIURL"), os.Getenv("AIModel")
-	if key == "" || url == "" || model == "" {
-		t.Skip("AI{Key,URL,Model} not set")
+	if *record && (key == "" || url == "" || model == "") {
+		t.Fatal("AI{Key,URL,Model} must be set to record")
+	}
+	content := "hello world"
+	c := &Client{
+		URL:   cmp.Or(url, "https://api.anthropic.com/v1/messages"),
+		Key:   key,
+		Model: model,
+		HTTP:  Replay(filepath.Join("testdata", "replay"), *record),
+	}
+	tools := []Tool{editTool(&content)}
+	ch := NewChat(c, "You have access to a file named 'test.txt'.", tools)
+	if err := ch.Loop(t.Context(), "In test.txt, replace 'world' with 'universe'", 10, nil); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if content != "hello universe" {
+		t.Fatalf("got %q, want 'hello universe'", content)
+	}
+}
+
+func TestReplayMissing(t *testing.T) {
+	c := &Client{URL: "http://localhost/v1/messages", HTTP: Replay(t.TempDir(), false)}
+	_, err := NewChat(c, "", nil).Send(t.Context(), "hello")
+	if err == nil || !strings.Contains(err.Error(), "no recording for POST /v1/messages") {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestRecording(t *testing.T) {
+	r, sse := &Recording{Root: t.TempDir()}, "event: a\ndata: {}\n\nevent: b\ndata: {}\n\n"
+	req, _ := http.NewRequest("POST", "http://localhost/v1/messages", strings.NewReader("not\n\njson"))
+	k, err := r.Key(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{
+		"Content-Type":              {"text/event-stream"},
+		"Request-Id":                {"req_1"},
+		"Set-Cookie":                {"session=x"},
+		"Anthropic-Organization-Id": {"org"},
+	}, Body: io.NopCloser(strings.NewReader(sse))}
+	if err := r.Set(k, req, res); err != nil {
+		t.Fatal(err)
+	} else if bs, err := os.ReadFile(k); err != nil {
+		t.Fatal(err)
+	} else if s := string(bs); !strings.Contains(s, "Content-Type") || strings.Contains(s, "req_1") ||
+		strings.Contains(s, "session") || strings.Contains(s, "Organization") {
+		t.Fatalf("expected identifying headers to be stripped: %s", s)
+	} else if res.Header.Get("Request-Id") != "req_1" {
+		t.Fatalf("expected response headers to be unchanged")
+	}
+	res, err = r.Get(k, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if bs, err := io.ReadAll(res.Body); err != nil || string(bs) != sse {
+		t.Fatalf("got body %q (%v), want %q", bs, err, sse)
+	} else if res.StatusCode != 200 || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("got response %d %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestStream(t *testing.T) {
+	c := replayServer(t, "stream_tool.sse")
+	ch := NewChat(c, "", nil)
+	text, tools := "", []Block{}
+	for b, err := range ch.Stream(t.Context(), "replace 'world' with 'universe'") {
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		} else if b.Type == "text" {
+			text += b.Text
+		} else {
+			tools = append(tools, b)
+		}
+	}
+	if text != "Let me edit that." {
+		t.Fatalf("got text %q", text)
+	} else if len(tools) != 1 || tools[0].ID != "toolu_01" || tools[0].Name != "edit" {
+		t.Fatalf("got tools %#v", tools)
+	} else if r := (struct{ Path, Find, Replace string }{}); json.Unmarshal(tools[0].Input, &r) != nil ||
+		r.Path != "test.txt" || r.Find != "world" || r.Replace != "universe" {
+		t.Fatalf("got tool input %s", tools[0].Input)
+	}
+	if len(ch.Messages) != 2 || ch.Messages[1].Role != "assistant" {
+		t.Fatalf("got messages %#v", ch.Messages)
+	} else if blks := ch.Messages[1].Content.([]Block); len(blks) != 2 ||
+		blks[0].Text != "Let me edit that." || string(blks[1].Input) != string(tools[0].Input) {
+		t.Fatalf("got assistant message %#v", blks)
+	}
+}
+
+func TestStreamBreak(t *testing.T) {
+	c := replayServer(t, "stream_tool.sse", "stream_tool.sse")
+	ch := NewChat(c, "", nil)
+	for _, err := range ch.Stream(t.Context(), "replace 'world' with 'universe'") {
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+		break
+	}
+	if len(ch.Messages) != 0 {
+		t.Fatalf("expected messages to be reset after break: %#v", ch.Messages)
+	}
+	for _, err := range ch.Stream(t.Context(), "replace 'world' with 'universe'") {
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+	}
+	if len(ch.Messages) != 2 || ch.Messages[0].Role != "user" || ch.Messages[1].Role != "assistant" {
+		t.Fatalf("got messages %#v", ch.Messages)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	c := replayServer(t, "stream_error.sse")
+	ch := NewChat(c, "", nil)
+	for _, err := range ch.Stream(t.Context(), "hello") {
+		if err == nil || !strings.Contains(err.Error(), "overloaded_error") {
+			t.Fatalf("got %v, want overloaded_error", err)
+		}
+	}
+	if len(ch.Messages) != 1 {
+		t.Fatalf("got %d messages, want only the user message", len(ch.Messages))
+	}
+}
+
+func TestStreamLoop(t *testing.T) {
+	content := "hello world"
+	c := replayServer(t, "stream_tool.sse", "stream_text.sse")
+	ch := NewChat(c, "", []Tool{editTool(&content)})
+	ch.Streaming = true
+	text := ""
+	err := ch.Loop(t.Context(), "replace 'world' with 'universe'", 10, func(b Block) {
+		if b.Type == "text" {
+			text += b.Text
+		}
+	})
+	if err != nil {
+		t.Fatalf("loop: %v", err)
+	} else if content != "hello universe" {
+		t.Fatalf("got %q, want 'hello universe'", content)
+	} else if text != "Let me edit that.Done." {
+		t.Fatalf("got text %q", text)
+	} else if len(ch.Messages) != 4 {
+		t.Fatalf("got %d messages, want 4", len(ch.Messages))
+	}
+}
+
+func TestUsage(t *testing.T) {
+	c := replayServer(t, "send_max_tokens.json", "stream_tool.sse")
+	ch, rs := NewChat(c, "", nil), []*Response{}
+	ch.OnResponse = func(r *Response) { rs = append(rs, r) }
+	r, err := ch.Send(t.Context(), "tell me a story")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	} else if r.ID != "msg_04" || r.StopReason != "max_tokens" || r.Usage.CacheReadInputTokens != 100 {
+		t.Fatalf("got %#v", r)
+	}
+	for _, err := range ch.Stream(t.Context(), "continue") {
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+	}
+	want := Usage{InputTokens: 54, OutputTokens: 40, CacheReadInputTokens: 100}
+	if ch.Usage != want {
+		t.Fatalf("got usage %#v, want %#v", ch.Usage, want)
+	} else if len(rs) != 2 || rs[1].ID != "msg_01" || rs[1].StopReason != "tool_use" || rs[1].Usage.OutputTokens != 37 {
+		t.Fatalf("got responses %#v", rs)
+	} else if c := ch.Usage.Cost(Price{Input: 3, Output: 15, CacheRead: 0.3}); c != (54*3+40*15+100*0.3)/1e6 {
+		t.Fatalf("got cost %f", c)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m, f := &ops.M{}, &Fake{Responses: []Response{
+		{Model: "m1", StopReason: "end_turn", Content: []Block{{Type: "text", Text: "a"}},
+			Usage: Usage{InputTokens: 10, OutputTokens: 20, CacheCreationInputTokens: 40, CacheReadInputTokens: 40}},
+		{Model: "m1", StopReason: "max_tokens", Content: []Block{{Type: "text", Text: "b"}},
+			Usage: Usage{InputTokens: 1, OutputTokens: 2}},
+	}}
+	ch := NewChat(&Client{Provider: f}, "", nil)
+	ch.OnResponse = Metrics(m, "my app", Price{Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3})
+	for _, input := range []string{"a", "b"} {
+		if _, err := ch.Send(t.Context(), input); err != nil {
+			t.Fatalf("send: %v", err)
+		}
+	}
+	kvs, tags := m.Collect(), "app=my\\ app,model=m1"
+	for k, v := range map[string]int64{
+		"ai_tokens_total," + tags + ",kind=input":                11,
+		"ai_tokens_total," + tags + ",kind=output":               22,
+		"ai_tokens_total," + tags + ",kind=cache_write":          40,
+		"ai_tokens_total," + tags + ",kind=cache_read":           40,
+		"ai_responses_total," + tags + ",stop_reason=end_turn":   1,
+		"ai_responses_total," + tags + ",stop_reason=max_tokens": 1,
+		"ai_cost_micros_total," + tags:                           11*3 + 22*15 + 40*3.75 + 40*0.3,
+	} {
+		if kvs[k] != v {
+			t.Fatalf("got %s = %v, want %d: %v", k, kvs[k], v, kvs)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	content := "hello world"
+	c, reqs := recordingServer(t, "stream_tool.sse", "stream_text.sse")
+	ch := NewChat(c, "", []Tool{editTool(&content)})
+	ch.Streaming, ch.Budget = true, 50
+	err, bErr := ch.Loop(t.Context(), "replace 'world' with 'universe'", 10, nil), &BudgetError{}
+	if !errors.As(err, &bErr) || bErr.Usage.Total() != 79 {
+		t.Fatalf("got %v, want budget error", err)
+	} else if content != "hello world" {
+		t.Fatalf("got %q, tool should not have run", content)
+	}
+	ch.Budget = 0
+	if err := ch.Loop(t.Context(), "never mind", 10, nil); err != nil {
+		t.Fatalf("loop after budget error: %v", err)
+	}
+	ms := (*reqs)[1]["messages"].([]any)
+	for i, m := range ms {
+		m := m.(map[string]any)
+		blks, _ := m["content"].([]any)
+		for _, b := range blks {
+			if b := b.(map[string]any); b["type"] == "tool_use" {
+				next, _ := ms[min(i+1, len(ms)-1)].(map[string]any)["content"].([]any)
+				if !slices.ContainsFunc(next, func(r any) bool { return r.(map[string]any)["tool_use_id"] == b["id"] }) {
+					t.Fatalf("tool_use %v without tool_result in %v", b["id"], ms)
+				}
+			}
+		}
+	}
+}
+
+func TestNewTool(t *testing.T) {
+	type Point struct{ X, Y float64 }
+	type In struct {
+		Name   string            `json:"name" desc:"shape name"`
+		Kind   string            `json:"kind" enum:"circle,square"`
+		Sides  int               `json:"sides,omitempty" enum:"3,4"`
+		Points []Point           `json:"points"`
+		Labels map[string]string `json:"labels,omitempty"`
+		Note   *string           `json:"note"`
+		Tags   []string          `json:"tags,omitempty" enum:"a,b"`
+	}
+	got := In{}
+	tool := NewTool("shape", "Draw a shape", func(_ context.Context, in In) (string, error) {
+		got = in
+		return "ok", nil
+	})
+	want := `{"type":"object","properties":{` +
+		`"kind":{"type":"string","enum":["circle","square"]},` +
+		`"labels":{"type":"object","additionalProperties":{"type":"string"}},` +
+		`"name":{"type":"string","description":"shape name"},` +
+		`"note":{"type":"string"},` +
+		`"points":{"type":"array","items":{"type":"object","properties":{"X":{"type":"number"},"Y":{"type":"number"}},` +
+		`"required":["X","Y"],"additionalProperties":false}},` +
+		`"sides":{"type":"integer","enum":[3,4]},` +
+		`"tags":{"type":"array","items":{"type":"string","enum":["a","b"]}}},` +
+		`"required":["name","kind","points"],"additionalProperties":false}`
+	if string(tool.Schema) != want {
+		t.Fatalf("got schema\n%s\nwant\n%s", tool.Schema, want)
+	}
+	for _, c := range []struct{ input, err string }{
+		{`{"name": "a", "kind": "circle", "points": []}`, ""},
+		{`{"name": "a", "kind": "circle"}`, `input: missing required field "points"`},
+		{`{"name": "a", "kind": "oval", "points": []}`, "input.kind: oval is not one of [circle square]"},
+		{`{"name": "a", "kind": "circle", "points": [], "sides": 5}`, "input.sides: 5 is not one of [3 4]"},
+		{`{"name": "a", "kind": "circle", "points": [{"X": "1", "Y": 2}]}`, "input.points[0].X: expected number, got string"},
+		{`{"name": "a", "kind": "circle", "points": [], "color": "red"}`, `input: unknown field "color"`},
+		{`{"name": 1, "kind": "circle", "points": []}`, "input.name: expected string, got number 1"},
+		{`{"name": "a", "kind": "circle", "points": [{"X": 1, "Y": 2}], "note": null}`, ""},
+		{`{"name": "a", "kind": "circle", "points": [{"X": 1, "Y": 2}], "tags": ["a", "b"]}`, ""},
+		{`{"name": "a", "kind": "circle", "points": [], "tags": ["a", "c"]}`, "input.tags[1]: c is not one of [a b]"},
+	} {
+		input, wantErr := c.input, c.err
+		_, _, err := tool.Handler(t.Context(), json.RawMessage(input))
+		if wantErr == "" && err != nil {
+			t.Fatalf("%s: unexpected error %v", input, err)
+		} else if wantErr != "" && (err == nil || err.Error() != "invalid input: "+wantErr) {
+			t.Fatalf("%s: got error %v, want %q", input, err, wantErr)
+		}
 	}
+	if got.Name != "a" || len(got.Points) != 1 || got.Points[0].Y != 2 {
+		t.Fatalf("got %#v", got)
+	}
+}
+
+func TestParallelTools(t *testing.T) {
+	c, reqs := recordingServer(t, "send_tools.json", "send_text.json")
+	wg, started := sync.WaitGroup{}, make(chan struct{})
+	wg.Add(2)
+	go func() { wg.Wait(); close(started) }()
+	fetch := NewTool("fetch", "Fetch a url", func(ctx context.Context, in struct {
+		URL string `json:"url"`
+	}) (string, error) {
+		wg.Done()
+		select {
+		case <-started:
+			return "fetched " + in.URL, nil
+		case <-time.After(time.Second):
+			return "", fmt.Errorf("%s: not run in parallel", in.URL)
+		}
+	})
+	hang := NewTool("hang", "Never returns", func(ctx context.Context, _ struct{}) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	})
+	hang.Timeout = 10 * time.Millisecond
+	ch, rbs := NewChat(c, "", []Tool{fetch, hang}), []Block{}
+	ch.Concurrency = 4
+	if err := ch.Loop(t.Context(), "fetch a and b", 10, func(b Block) {
+		if b.Type == "tool" {
+			rbs = append(rbs, b)
+		}
+	}); err != nil {
+		t.Fatalf("loop: %v", err)
+	}
+	if len(rbs) != 4 || rbs[0].ID != "toolu_a" || rbs[3].ID != "toolu_d" {
+		t.Fatalf("got tool blocks out of order: %#v", rbs)
+	} else if rbs[0].IsError || rbs[1].IsError || !rbs[2].IsError || !rbs[3].IsError {
+		t.Fatalf("got tool blocks with unexpected errors: %#v", rbs)
+	}
+	ms := (*reqs)[1]["messages"].([]any)
+	bs, _ := json.Marshal(ms[len(ms)-1].(map[string]any)["content"])
+	want := `[{"content":"fetched a","tool_use_id":"toolu_a","type":"tool_result"},` +
+		`{"content":"fetched b","tool_use_id":"toolu_b","type":"tool_result"},` +
+		`{"content":"context deadline exceeded","is_error":true,"tool_use_id":"toolu_c","type":"tool_result"},` +
+		`{"content":"tool \"missing\" not found","is_error":true,"tool_use_id":"toolu_d","type":"tool_result"}]`
+	if string(bs) != want {
+		t.Fatalf("got tool results\n%s\nwant\n%s", bs, want)
+	}
+}
+
+func TestOpenAI(t *testing.T) {
 	content := "hello world"
-	c := &Client{URL: url, Key: key, Model: model}
-	tools := []Tool{{
+	c, reqs := recordingServer(t, "openai_tools.json", "openai_stream.sse")
+	c.Provider = OpenAI{}
+	ch := NewChat(c, "be brief", []Tool{editTool(&content)})
+	r, err := ch.Send(t.Context(), "replace 'world' with 'universe'")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	} else if r.StopReason != "tool_use" || r.Usage.InputTokens != 50 || len(r.Content) != 1 ||
+		r.Content[0].ID != "call_a" || r.Content[0].Name != "edit" {
+		t.Fatalf("got %#v", r)
+	}
+	text := ""
+	ch.Streaming = true
+	if err := ch.Loop(t.Context(), []Block{{Type: "tool_result", ToolUseID: "call_a", Content: "success"}}, 2,
+		func(b Block) { text += b.Text }); err != nil {
+		t.Fatalf("loop: %v", err)
+	} else if text != "Done." || ch.Usage != (Usage{InputTokens: 100, OutputTokens: 22, CacheReadInputTokens: 40}) {
+		t.Fatalf("got %q %#v", text, ch.Usage)
+	}
+	bs, _ := json.Marshal((*reqs)[1]["messages"])
+	want := `[{"content":"be brief","role":"system"},` +
+		`{"content":"replace 'world' with 'universe'","role":"user"},` +
+		`{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":` +
+		`"{\"path\":\"test.txt\",\"find\":\"world\",\"replace\":\"universe\"}","name":"edit"},"id":"call_a","type":"function"}]},` +
+		`{"content":"success","role":"tool","tool_call_id":"call_a"}]`
+	if string(bs) != want {
+		t.Fatalf("got messages\n%s\nwant\n%s", bs, want)
+	} else if tools := (*reqs)[1]["tools"].([]any); len(tools) != 1 || (*reqs)[1]["stream"] != true {
+		t.Fatalf("got request %#v", (*reqs)[1])
+	}
+}
+
+func TestOpenAIStreamTools(t *testing.T) {
+	c := replayServer(t, "openai_stream_tools.sse")
+	c.Provider = OpenAI{}
+	tools := []Block{}
+	for b, err := range NewChat(c, "", nil).Stream(t.Context(), "replace 'world' with 'universe'") {
+		if err != nil {
+			t.Fatalf("stream: %v", err)
+		}
+		tools = append(tools, b)
+	}
+	if len(tools) != 1 || tools[0].ID != "call_b" ||
+		string(tools[0].Input) != `{"path":"test.txt","find":"world","replace":"universe"}` {
+		t.Fatalf("got %#v", tools)
+	}
+}
+
+func TestFake(t *testing.T) {
+	content, f := "hello world", &Fake{Responses: []Response{
+		{Content: []Block{{Type: "tool_use", ID: "1", Name: "edit",
+			Input: json.RawMessage(`{"path": "test.txt", "find": "world", "replace": "universe"}`)}}},
+		{Content: []Block{{Type: "text", Text: "Done."}}, StopReason: "end_turn"},
+	}}
+	ch := NewChat(&Client{Provider: f}, "", []Tool{editTool(&content)})
+	if err := ch.Loop(t.Context(), "replace 'world' with 'universe'", 10, nil); err != nil {
+		t.Fatalf("loop: %v", err)
+	} else if content != "hello universe" {
+		t.Fatalf("got %q, want 'hello universe'", content)
+	} else if len(f.Requests) != 2 || len(f.Requests[1]) != 3 {
+		t.Fatalf("got requests %#v", f.Requests)
+	} else if rb := blocks(f.Requests[1][2].Content); rb[0].ToolUseID != "1" || rb[0].Content != "success" {
+		t.Fatalf("got tool result %#v", rb)
+	} else if _, err := ch.Send(t.Context(), "again"); err == nil {
+		t.Fatalf("expected error after responses ran out")
+	}
+}
+
+func TestExtract(t *testing.T) {
+	type Record struct {
+		Title string  `json:"title"`
+		Price float64 `json:"price"`
+	}
+	f := &Fake{Responses: []Response{
+		{Content: []Block{{Type: "tool_use", ID: "1", Name: "extract", Input: json.RawMessage(`{"title": "a"}`)},
+			{Type: "tool_use", ID: "1b", Name: "extract", Input: json.RawMessage(`{"title": "b", "price": 2}`)}}},
+		{Content: []Block{{Type: "tool_use", ID: "2", Name: "extract", Input: json.RawMessage(`{"title": "a", "price": 1.5}`)},
+			{Type: "tool_use", ID: "2b", Name: "extract", Input: json.RawMessage(`{"title": "b"}`)}}},
+		{Content: []Block{{Type: "tool_use", ID: "3", Name: "extract", Input: json.RawMessage(`{"value": ["a", "b"]}`)}}},
+	}}
+	ch := NewChat(&Client{Provider: f}, "", nil)
+	r, err := Extract[Record](t.Context(), ch, "extract the record", 1)
+	if err != nil || r != (Record{"a", 1.5}) {
+		t.Fatalf("got %v %v", r, err)
+	} else if rb := blocks(f.Requests[1][2].Content); len(rb) != 2 || !rb[0].IsError ||
+		rb[0].Content != `invalid input: input: missing required field "price"` ||
+		rb[1].ToolUseID != "1b" || !rb[1].IsError || rb[1].Content != "only the first extract call is used" {
+		t.Fatalf("got tool results %#v", rb)
+	} else if rb := blocks(ch.Messages[4].Content); len(rb) != 2 || rb[0].IsError || rb[0].Content != "ok" ||
+		rb[1].ToolUseID != "2b" || !rb[1].IsError {
+		t.Fatalf("got tool results %#v", rb)
+	} else if len(ch.Messages) != 5 || ch.Tools != nil || ch.ToolChoice != "" {
+		t.Fatalf("got chat %#v", ch)
+	}
+	tags, err := Extract[[]string](t.Context(), ch, "extract the tags", 0)
+	if err != nil || !slices.Equal(tags, []string{"a", "b"}) {
+		t.Fatalf("got %v %v", tags, err)
+	} else if _, err := Extract[Record](t.Context(), ch, "again", 0); err == nil {
+		t.Fatalf("expected error after responses ran out")
+	}
+
+	c, reqs := recordingServer(t, "send_text.json", "openai_tools.json")
+	if _, err := Extract[Record](t.Context(), NewChat(c, "", nil), "extract", 0); err == nil {
+		t.Fatalf("expected error for text response")
+	}
+	c.Provider = OpenAI{}
+	Extract[Record](t.Context(), NewChat(c, "", nil), "extract", 0)
+	if s := fmt.Sprint((*reqs)[0]["tool_choice"]); s != "map[name:extract type:tool]" {
+		t.Fatalf("got anthropic tool_choice %s", s)
+	} else if s := fmt.Sprint((*reqs)[1]["tool_choice"]); s != "map[function:map[name:extract] type:function]" {
+		t.Fatalf("got openai tool_choice %s", s)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	f := &Fake{}
+	for i := range 6 {
+		f.Responses = append(f.Responses, Response{Content: []Block{
+			{Type: "text", Text: fmt.Sprintf("step %d", i)},
+			{Type: "tool_use", ID: fmt.Sprint(i), Name: "read", Input: json.RawMessage(`{}`)},
+		}})
+	}
+	f.Responses = append(f.Responses, Response{Content: []Block{{Type: "text", Text: "Done."}}})
+	read := NewTool("read", "Read a file", func(context.Context, struct{}) (string, error) {
+		return strings.Repeat("x", 1000), nil
+	})
+	summaries := []int{}
+	ch := NewChat(&Client{Provider: f}, "", []Tool{read})
+	ch.Compaction = &Compaction{Threshold: 200, Keep: 2, MaxToolOutput: 100,
+		Summarize: func(_ context.Context, ms []Message) (string, error) {
+			summaries = append(summaries, len(ms))
+			return fmt.Sprintf("%d messages", len(ms)), nil
+		},
+	}
+	if err := ch.Loop(t.Context(), "read all files", 10, nil); err != nil {
+		t.Fatalf("loop: %v", err)
+	}
+	for i, ms := range f.Requests {
+		if task := blocks(ms[0].Content); task[0].Text != "read all files" {
+			t.Fatalf("request %d: task not kept: %#v", i, task)
+		}
+		for j, m := range ms {
+			for _, b := range blocks(m.Content) {
+				if s, _ := b.Content.(string); len(s) > 100+len("\n[truncated 900 chars]") {
+					t.Fatalf("request %d: tool result not truncated: %d", i, len(s))
+				} else if b.Type == "tool_result" && !slices.ContainsFunc(blocks(ms[j-1].Content), func(u Block) bool {
+					return u.Type == "tool_use" && u.ID == b.ToolUseID
+				}) {
+					t.Fatalf("request %d: tool result %s without tool use", i, b.ToolUseID)
+				}
+			}
+		}
+		if n := len(ms); i >= 2 && n > 5 {
+			t.Fatalf("request %d: got %d messages, want at most task + 2 turns", i, n)
+		}
+	}
+	last := blocks(f.Requests[6][0].Content)
+	if len(last) != 2 || last[1].Text != "[compacted] Summary of the earlier conversation:\n3 messages" {
+		t.Fatalf("got first message %#v", last)
+	} else if !slices.Equal(summaries, []int{3, 3, 3, 3}) {
+		t.Fatalf("got summaries of %v messages", summaries)
+	}
+}
+
+func TestContent(t *testing.T) {
+	dir, img := t.TempDir(), &bytes.Buffer{}
+	if err := png.Encode(img, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "a.png"), img.Bytes(), 0644)
+	os.WriteFile(filepath.Join(dir, "b.txt"), []byte("hello"), 0644)
+	os.WriteFile(filepath.Join(dir, "c.bin"), []byte{0, 1, 2}, 0644)
+	a, aErr := File(filepath.Join(dir, "a.png"))
+	b, bErr := File(filepath.Join(dir, "b.txt"))
+	if _, err := File(filepath.Join(dir, "c.bin")); aErr != nil || bErr != nil || err == nil {
+		t.Fatalf("got errors %v %v %v", aErr, bErr, err)
+	} else if a.Type != "image" || a.Source.MediaType != "image/png" || a.Source.Type != "base64" {
+		t.Fatalf("got %#v", a.Source)
+	} else if b.Type != "document" || b.Title != "b.txt" || b.Source.Type != "text" || b.Source.Data != "hello" {
+		t.Fatalf("got %#v", b.Source)
+	}
+
+	c, reqs := recordingServer(t, "send_text.json", "openai_tools.json")
+	ch := NewChat(c, "long system prompt", nil)
+	ch.CacheSystem = true
+	if _, err := ch.Send(t.Context(), []Block{a, Cached(b), Text("describe")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	bs, _ := json.Marshal((*reqs)[0]["system"])
+	if want := `[{"cache_control":{"type":"ephemeral"},"text":"long system prompt","type":"text"}]`; string(bs) != want {
+		t.Fatalf("got system %s, want %s", bs, want)
+	}
+	bs, _ = json.Marshal((*reqs)[0]["messages"].([]any)[0].(map[string]any)["content"])
+	want := `[{"source":{"data":"` + a.Source.Data + `","media_type":"image/png","type":"base64"},"type":"image"},` +
+		`{"cache_control":{"type":"ephemeral"},"source":{"data":"hello","media_type":"text/plain","type":"text"},` +
+		`"title":"b.txt","type":"document"},{"text":"describe","type":"text"}]`
+	if string(bs) != want {
+		t.Fatalf("got content\n%s\nwant\n%s", bs, want)
+	}
+
+	c.Provider, ch.Messages = OpenAI{}, ch.Messages[:1]
+	if _, err := ch.Send(t.Context(), nil); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	bs, _ = json.Marshal((*reqs)[1]["messages"].([]any)[1].(map[string]any)["content"])
+	want = `[{"image_url":{"url":"data:image/png;base64,` + a.Source.Data + `"},"type":"image_url"},` +
+		`{"text":"hello","type":"text"},{"text":"describe","type":"text"}]`
+	if string(bs) != want {
+		t.Fatalf("got content\n%s\nwant\n%s", bs, want)
+	}
+}
+
+func replayServer(t *testing.T, fixtures ...string) *Client {
+	c, _ := recordingServer(t, fixtures...)
+	return c
+}
+
+func recordingServer(t *testing.T, fixtures ...string) (*Client, *[]map[string]any) {
+	i, reqs := 0, &[]map[string]any{}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := map[string]any{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		*reqs = append(*reqs, req)
+		if i >= len(fixtures) {
+			http.Error(w, "no more fixtures", http.StatusInternalServerError)
+			return
+		}
+		bs, err := os.ReadFile(filepath.Join("testdata", fixtures[i]))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		i++
+		if filepath.Ext(fixtures[i-1]) == ".sse" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write(bs)
+	}))
+	t.Cleanup(s.Close)
+	return &Client{URL: s.URL, Key: "key", Model: "model"}, reqs
+}
+
+func editTool(content *string) Tool {
+	return Tool{
 		Name:        "edit",
 		Description: "Replace text in a file",
 		Schema:      MapStringArgs("path", "find", "replace"),
@@ -26,18 +623,11 @@ func TestAgent(t *testing.T) {
 				return "", Block{}, err
 			} else if r.Path != "test.txt" {
 				return "", Block{}, fmt.Errorf("file %q not found", r.Path)
-			} else if !strings.Contains(content, r.Find) {
+			} else if !strings.Contains(*content, r.Find) {
 				return "", Block{}, fmt.Errorf("string %q not found", r.Find)
 			}
-			content = strings.Replace(content, r.Find, r.Replace, 1)
+			*content = strings.Replace(*content, r.Find, r.Replace, 1)
 			return "success", Block{Text: "edit"}, nil
 		},
-	}}
-	ch := NewChat(c, "You have access to a file named 'test.txt'.", tools)
-	if err := ch.Loop(t.Context(), "In test.txt, replace 'world' with 'universe'", 10, nil); err != nil {
-		t.Fatalf("run: %v", err)
-	}
-	if content != "hello universe" {
-		t.Fatalf("got %q, want 'hello universe'", content)
 	}
 }
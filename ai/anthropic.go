@@ -0,0 +1,119 @@
+package ai
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Anthropic implements the Messages API
+type Anthropic struct{}
+
+type event struct {
+	Type    string   `json:"type"`
+	Index   int      `json:"index"`
+	Message Response `json:"message"`
+	Block   Block    `json:"content_block"`
+	Usage   Usage    `json:"usage"`
+	Delta   struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
+	} `json:"delta"`
+	Error struct{ Type, Message string } `json:"error"`
+}
+
+func (a Anthropic) Send(ctx context.Context, ch *Chat) (*Response, error) {
+	resp, err := a.post(ctx, ch, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	r := &Response{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	}
+	return r, nil
+}
+
+func (a Anthropic) Stream(ctx context.Context, ch *Chat, f func(Block) bool) (*Response, error) {
+	resp, err := a.post(ctx, ch, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	r, inputs := &Response{}, map[int][]byte{}
+	for bs, err := range events(resp.Body) {
+		e := event{}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		} else if err := json.Unmarshal(bs, &e); err != nil {
+			return nil, fmt.Errorf("parse: %w", err)
+		} else if strings.HasPrefix(e.Type, "content_block_") && (e.Index < 0 || e.Index > len(r.Content) ||
+			e.Type != "content_block_start" && e.Index == len(r.Content)) {
+			return nil, fmt.Errorf("parse: unexpected %s for block %d", e.Type, e.Index)
+		}
+		switch e.Type {
+		case "error":
+			return nil, fmt.Errorf("stream %s: %s", e.Error.Type, e.Error.Message)
+		case "message_start":
+			r.ID, r.Model, r.Usage = e.Message.ID, e.Message.Model, e.Message.Usage
+		case "content_block_start":
+			if e.Block.Type == "tool_use" {
+				e.Block.Input = nil
+			}
+			r.Content = append(r.Content, e.Block)
+		case "content_block_delta":
+			switch e.Delta.Type {
+			case "text_delta":
+				r.Content[e.Index].Text += e.Delta.Text
+				if !f(Block{Type: "text", Text: e.Delta.Text}) {
+					return nil, nil
+				}
+			case "input_json_delta":
+				inputs[e.Index] = append(inputs[e.Index], e.Delta.PartialJSON...)
+			}
+		case "content_block_stop":
+			if b := &r.Content[e.Index]; b.Type == "tool_use" {
+				b.Input = json.RawMessage(cmp.Or(string(inputs[e.Index]), "{}"))
+				if !f(*b) {
+					return nil, nil
+				}
+			}
+		case "message_delta":
+			r.StopReason = e.Delta.StopReason
+			r.Usage.OutputTokens = e.Usage.OutputTokens
+		case "message_stop":
+			return r, nil
+		}
+	}
+	return nil, fmt.Errorf("read: %w", io.ErrUnexpectedEOF)
+}
+
+func (a Anthropic) post(ctx context.Context, ch *Chat, stream bool) (*http.Response, error) {
+	m := map[string]any{
+		"model":       ch.Model,
+		"max_tokens":  ch.MaxTokens,
+		"system":      ch.System,
+		"messages":    ch.Messages,
+		"tools":       ch.Tools,
+		"temperature": ch.Temperature,
+	}
+	if stream {
+		m["stream"] = true
+	}
+	if ch.ToolChoice == "any" {
+		m["tool_choice"] = map[string]any{"type": "any"}
+	} else if ch.ToolChoice != "" {
+		m["tool_choice"] = map[string]any{"type": "tool", "name": ch.ToolChoice}
+	}
+	if ch.CacheSystem && ch.System != "" {
+		m["system"] = []Block{Cached(Text(ch.System))}
+	}
+	return ch.post(ctx, m, "X-Api-Key", ch.Key, "Anthropic-Version", "2023-06-01")
+}
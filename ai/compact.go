@@ -0,0 +1,108 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Compaction shrinks the messages of a Chat once they are estimated to exceed Threshold tokens.
+// All turns (assistant messages and their tool results) but the last Keep are replaced with
+// a summary (or dropped if Summarize is nil); the first message (i.e. the task) is always kept
+// and the summary is appended to it.
+type Compaction struct {
+	Threshold     int
+	Keep          int
+	MaxToolOutput int // max chars per tool result; 0 is unlimited
+	Summarize     func(context.Context, []Message) (string, error)
+}
+
+const compacted = "[compacted] "
+
+// EstimateTokens roughly estimates the tokens of system and ms as 4 bytes per token
+func EstimateTokens(system string, ms []Message) int {
+	bs, _ := json.Marshal(ms)
+	return (len(system) + len(bs)) / 4
+}
+
+// Summarizer returns a Compaction.Summarize func that asks the model of c for a summary
+func Summarizer(c *Client) func(context.Context, []Message) (string, error) {
+	return func(ctx context.Context, ms []Message) (string, error) {
+		w := &strings.Builder{}
+		for _, m := range ms {
+			for _, b := range blocks(m.Content) {
+				switch b.Type {
+				case "text":
+					fmt.Fprintf(w, "%s: %s\n", m.Role, b.Text)
+				case "tool_use":
+					fmt.Fprintf(w, "%s called %s(%s)\n", m.Role, b.Name, b.Input)
+				case "tool_result":
+					fmt.Fprintf(w, "tool result: %s\n", text(b.Content))
+				}
+			}
+		}
+		ch := NewChat(c, "Summarize the following conversation between a user and an assistant. "+
+			"Keep all facts, decisions and open tasks needed to continue it.", nil)
+		r, err := ch.Send(ctx, w.String())
+		if err != nil {
+			return "", fmt.Errorf("summarize: %w", err)
+		}
+		return text(r.Content), nil
+	}
+}
+
+// Compact applies ch.Compaction to ch.Messages
+func (ch *Chat) Compact(ctx context.Context) error {
+	c := ch.Compaction
+	if c == nil {
+		return nil
+	}
+	for i, m := range ch.Messages {
+		ch.Messages[i].Content = c.truncate(m.Content)
+	}
+	if EstimateTokens(ch.System, ch.Messages) <= c.Threshold {
+		return nil
+	}
+	i, keep := len(ch.Messages), max(c.Keep, 1)
+	for n := 0; n < keep && i > 0; {
+		if i--; ch.Messages[i].Role == "assistant" {
+			n++
+		}
+	}
+	if i <= 1 || ch.Messages[i].Role != "assistant" {
+		return nil
+	}
+	note := compacted + "Earlier messages were omitted."
+	if c.Summarize != nil {
+		s, err := c.Summarize(ctx, ch.Messages[:i])
+		if err != nil {
+			return err
+		}
+		note = compacted + "Summary of the earlier conversation:\n" + s
+	}
+	task := slices.DeleteFunc(slices.Clone(blocks(ch.Messages[0].Content)), func(b Block) bool {
+		return b.Type == "text" && strings.HasPrefix(b.Text, compacted)
+	})
+	first := Message{Role: ch.Messages[0].Role, Content: append(task, Block{Type: "text", Text: note})}
+	ch.Messages = append([]Message{first}, ch.Messages[i:]...)
+	return nil
+}
+
+func (c *Compaction) truncate(v any) any {
+	blks, ok := v.([]Block)
+	if c == nil || c.MaxToolOutput <= 0 || !ok {
+		return v
+	}
+	cloned := false
+	for i, b := range blks {
+		if s, ok := b.Content.(string); ok && b.Type == "tool_result" && len(s) > c.MaxToolOutput {
+			if !cloned {
+				blks, cloned = slices.Clone(blks), true
+			}
+			blks[i].Content = fmt.Sprintf("%s\n[truncated %d chars]", s[:c.MaxToolOutput], len(s)-c.MaxToolOutput)
+		}
+	}
+	return blks
+}
@@ -0,0 +1,80 @@
+package ai
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func Text(s string) Block {
+	return Block{Type: "text", Text: s}
+}
+
+// Cached returns b marked as an (ephemeral) cache breakpoint
+func Cached(b Block) Block {
+	b.Cache = &CacheControl{Type: "ephemeral"}
+	return b
+}
+
+// Image returns an image block; the media type is detected if empty
+func Image(bs []byte, mediaType string) Block {
+	return Block{Type: "image", Source: &Source{
+		Type: "base64", MediaType: detect(bs, mediaType), Data: base64.StdEncoding.EncodeToString(bs),
+	}}
+}
+
+func ImageURL(url string) Block {
+	return Block{Type: "image", Source: &Source{Type: "url", URL: url}}
+}
+
+// Document returns a document block for pdf or text content; the media type is detected if empty
+func Document(title string, bs []byte, mediaType string) Block {
+	if mediaType = detect(bs, mediaType); strings.HasPrefix(mediaType, "text/") {
+		return Block{Type: "document", Title: title, Source: &Source{Type: "text", MediaType: "text/plain", Data: string(bs)}}
+	}
+	return Block{Type: "document", Title: title, Source: &Source{
+		Type: "base64", MediaType: mediaType, Data: base64.StdEncoding.EncodeToString(bs),
+	}}
+}
+
+func DocumentURL(title, url string) Block {
+	return Block{Type: "document", Title: title, Source: &Source{Type: "url", URL: url}}
+}
+
+// File returns an image or document block for the file at path based on its media type
+func File(path string) (Block, error) {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return Block{}, err
+	}
+	mediaType := detect(bs, mime.TypeByExtension(filepath.Ext(path)))
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return Image(bs, mediaType), nil
+	case mediaType == "application/pdf", strings.HasPrefix(mediaType, "text/"):
+		return Document(filepath.Base(path), bs, mediaType), nil
+	}
+	return Block{}, fmt.Errorf("file %q: unsupported media type %q", path, mediaType)
+}
+
+func detect(bs []byte, mediaType string) string {
+	if mediaType == "" {
+		mediaType = http.DetectContentType(bs)
+	}
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	return strings.TrimSpace(mediaType)
+}
+
+// dataURL returns the source as url or data url
+func (s *Source) dataURL() string {
+	if s.Type == "url" {
+		return s.URL
+	} else if s.Type == "text" {
+		return "data:" + s.MediaType + ";base64," + base64.StdEncoding.EncodeToString([]byte(s.Data))
+	}
+	return "data:" + s.MediaType + ";base64," + s.Data
+}
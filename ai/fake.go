@@ -0,0 +1,40 @@
+package ai
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Fake is a Provider that replays Responses in order and records the messages it was sent.
+// It allows agent logic to be tested offline.
+type Fake struct {
+	Responses []Response
+	Requests  [][]Message
+	sync.Mutex
+}
+
+func (f *Fake) Send(_ context.Context, ch *Chat) (*Response, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.Requests = append(f.Requests, slices.Clone(ch.Messages))
+	if i := len(f.Requests) - 1; i < len(f.Responses) {
+		r := f.Responses[i]
+		return &r, nil
+	}
+	return nil, fmt.Errorf("fake: no response for request %d", len(f.Requests))
+}
+
+func (f *Fake) Stream(ctx context.Context, ch *Chat, fn func(Block) bool) (*Response, error) {
+	r, err := f.Send(ctx, ch)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range r.Content {
+		if (b.Type == "text" || b.Type == "tool_use") && !fn(b) {
+			return nil, nil
+		}
+	}
+	return r, nil
+}
@@ -0,0 +1,229 @@
+package ai
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// OpenAI implements OpenAI compatible chat completions APIs (e.g. llama.cpp, ollama).
+// Client.URL is the full chat completions endpoint; Client.Key is optional.
+type OpenAI struct{}
+
+type openAIChoice struct {
+	Message, Delta struct {
+		Content   string `json:"content"`
+		ToolCalls []struct {
+			Index    int    `json:"index"`
+			ID       string `json:"id"`
+			Function struct {
+				Name      string `json:"name"`
+				Arguments string `json:"arguments"`
+			} `json:"function"`
+		} `json:"tool_calls"`
+	}
+	FinishReason string `json:"finish_reason"`
+}
+
+type openAIResponse struct {
+	ID      string         `json:"id"`
+	Model   string         `json:"model"`
+	Choices []openAIChoice `json:"choices"`
+	Usage   *struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage"`
+	Error *struct{ Message string } `json:"error"`
+}
+
+var openAIStopReasons = map[string]string{
+	"stop":           "end_turn",
+	"length":         "max_tokens",
+	"tool_calls":     "tool_use",
+	"function_call":  "tool_use",
+	"content_filter": "refusal",
+}
+
+func (o OpenAI) Send(ctx context.Context, ch *Chat) (*Response, error) {
+	resp, err := o.post(ctx, ch, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	x := openAIResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&x); err != nil {
+		return nil, fmt.Errorf("parse: %w", err)
+	} else if len(x.Choices) == 0 {
+		return nil, fmt.Errorf("parse: no choices")
+	}
+	r, c := x.response(), x.Choices[0]
+	if c.Message.Content != "" {
+		r.Content = append(r.Content, Block{Type: "text", Text: c.Message.Content})
+	}
+	for i, tc := range c.Message.ToolCalls {
+		r.Content = append(r.Content, Block{
+			Type: "tool_use", ID: cmp.Or(tc.ID, fmt.Sprintf("call_%d", i)), Name: tc.Function.Name,
+			Input: json.RawMessage(cmp.Or(tc.Function.Arguments, "{}")),
+		})
+	}
+	r.StopReason = cmp.Or(openAIStopReasons[c.FinishReason], c.FinishReason)
+	return r, nil
+}
+
+func (o OpenAI) Stream(ctx context.Context, ch *Chat, f func(Block) bool) (*Response, error) {
+	resp, err := o.post(ctx, ch, true)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	r, txt, calls, args := &Response{}, "", []Block{}, map[int][]byte{}
+	for bs, err := range events(resp.Body) {
+		x := openAIResponse{}
+		if err != nil {
+			return nil, fmt.Errorf("read: %w", err)
+		} else if string(bs) == "[DONE]" {
+			if txt != "" {
+				r.Content = append(r.Content, Block{Type: "text", Text: txt})
+			}
+			for i, b := range calls {
+				b.ID, b.Input = cmp.Or(b.ID, fmt.Sprintf("call_%d", i)), json.RawMessage(cmp.Or(string(args[i]), "{}"))
+				if r.Content = append(r.Content, b); !f(b) {
+					return nil, nil
+				}
+			}
+			return r, nil
+		} else if err := json.Unmarshal(bs, &x); err != nil {
+			return nil, fmt.Errorf("parse: %w", err)
+		} else if x.Error != nil {
+			return nil, fmt.Errorf("stream: %s", x.Error.Message)
+		}
+		if r.ID == "" {
+			r.ID, r.Model = x.ID, x.Model
+		}
+		if x.Usage != nil {
+			r.Usage = x.response().Usage
+		}
+		for _, c := range x.Choices {
+			if c.FinishReason != "" {
+				r.StopReason = cmp.Or(openAIStopReasons[c.FinishReason], c.FinishReason)
+			}
+			if c.Delta.Content != "" {
+				txt += c.Delta.Content
+				if !f(Block{Type: "text", Text: c.Delta.Content}) {
+					return nil, nil
+				}
+			}
+			for _, tc := range c.Delta.ToolCalls {
+				for len(calls) <= tc.Index {
+					calls = append(calls, Block{Type: "tool_use"})
+				}
+				b := &calls[tc.Index]
+				b.ID, b.Name = cmp.Or(b.ID, tc.ID), cmp.Or(b.Name, tc.Function.Name)
+				args[tc.Index] = append(args[tc.Index], tc.Function.Arguments...)
+			}
+		}
+	}
+	return nil, fmt.Errorf("read: %w", io.ErrUnexpectedEOF)
+}
+
+func (x openAIResponse) response() *Response {
+	r := &Response{ID: x.ID, Model: x.Model}
+	if u := x.Usage; u != nil {
+		r.Usage.InputTokens = u.PromptTokens - u.PromptTokensDetails.CachedTokens
+		r.Usage.OutputTokens = u.CompletionTokens
+		r.Usage.CacheReadInputTokens = u.PromptTokensDetails.CachedTokens
+	}
+	return r
+}
+
+func (o OpenAI) post(ctx context.Context, ch *Chat, stream bool) (*http.Response, error) {
+	m := map[string]any{
+		"model":       ch.Model,
+		"max_tokens":  ch.MaxTokens,
+		"messages":    o.messages(ch),
+		"temperature": ch.Temperature,
+	}
+	if len(ch.Tools) != 0 {
+		tools := []map[string]any{}
+		for _, t := range ch.Tools {
+			tools = append(tools, map[string]any{"type": "function", "function": map[string]any{
+				"name": t.Name, "description": t.Description, "parameters": t.Schema,
+			}})
+		}
+		m["tools"] = tools
+	}
+	if ch.ToolChoice == "any" {
+		m["tool_choice"] = "required"
+	} else if ch.ToolChoice != "" {
+		m["tool_choice"] = map[string]any{"type": "function", "function": map[string]any{"name": ch.ToolChoice}}
+	}
+	if stream {
+		m["stream"], m["stream_options"] = true, map[string]any{"include_usage": true}
+	}
+	headers := []string{}
+	if ch.Key != "" {
+		headers = append(headers, "Authorization", "Bearer "+ch.Key)
+	}
+	return ch.post(ctx, m, headers...)
+}
+
+func (o OpenAI) messages(ch *Chat) []map[string]any {
+	ms := []map[string]any{}
+	if ch.System != "" {
+		ms = append(ms, map[string]any{"role": "system", "content": ch.System})
+	}
+	for _, m := range ch.Messages {
+		texts, parts, calls := []string{}, []map[string]any{}, []map[string]any{}
+		for _, b := range blocks(m.Content) {
+			switch b.Type {
+			case "text":
+				texts, parts = append(texts, b.Text), append(parts, map[string]any{"type": "text", "text": b.Text})
+			case "image":
+				parts = append(parts, map[string]any{"type": "image_url", "image_url": map[string]any{"url": b.Source.dataURL()}})
+			case "document":
+				if b.Source.Type == "text" {
+					texts, parts = append(texts, b.Source.Data), append(parts, map[string]any{"type": "text", "text": b.Source.Data})
+				} else {
+					parts = append(parts, map[string]any{"type": "file", "file": map[string]any{
+						"filename": b.Title, "file_data": b.Source.dataURL(),
+					}})
+				}
+			case "tool_use":
+				calls = append(calls, map[string]any{"id": b.ID, "type": "function", "function": map[string]any{
+					"name": b.Name, "arguments": cmp.Or(string(b.Input), "{}"),
+				}})
+			case "tool_result":
+				ms = append(ms, map[string]any{"role": "tool", "tool_call_id": b.ToolUseID, "content": text(b.Content)})
+			}
+		}
+		if m.Role == "assistant" && len(calls) != 0 {
+			ms = append(ms, map[string]any{"role": m.Role, "content": strings.Join(texts, "\n"), "tool_calls": calls})
+		} else if len(parts) != len(texts) {
+			ms = append(ms, map[string]any{"role": m.Role, "content": parts})
+		} else if len(texts) != 0 {
+			ms = append(ms, map[string]any{"role": m.Role, "content": strings.Join(texts, "\n")})
+		}
+	}
+	return ms
+}
+
+// text returns the concatenated text of content (string or []Block)
+func text(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	texts := []string{}
+	for _, b := range blocks(v) {
+		if b.Type == "text" {
+			texts = append(texts, b.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
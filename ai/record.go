@@ -0,0 +1,134 @@
+package ai
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/niklasfasching/x/soup"
+)
+
+// Recording is a soup.Cache for api requests. Requests are matched on method, path and
+// normalized json body (keys sorted, model removed) so recordings can be replayed
+// independent of host and model. A recording is a `METHOD PATH BODY_LENGTH` line followed
+// by the (indented) request body, a newline and the dumped response.
+type Recording struct {
+	Root   string
+	Update bool // ignore existing recordings and record them again
+}
+
+type offline struct{}
+
+var recordingNameChars = regexp.MustCompile(`[^-_0-9a-zA-Z]+`)
+
+// recordingSkipHeaders are not recorded as they identify the account or request (or just add noise)
+var recordingSkipHeaders = []string{"Request-Id", "X-Request-Id", "Set-Cookie", "Anthropic-Organization-Id",
+	"Openai-Organization", "Openai-Project", "Cf-Ray", "Date", "Server"}
+
+// Replay returns a client that replays the recordings in root and fails for unknown requests.
+// If update is set, requests are sent and (re-)recorded instead.
+func Replay(root string, update bool) *http.Client {
+	t := soup.Transport{Cache: &Recording{Root: root, Update: update}, Transport: offline{}}
+	if update {
+		t.Transport = http.DefaultTransport
+	}
+	return t.Client()
+}
+
+func (offline) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, fmt.Errorf("no recording for %s %s", req.Method, req.URL.Path)
+}
+
+func (r *Recording) Key(req *http.Request) (string, error) {
+	bs, err := r.body(req)
+	if err != nil {
+		return "", err
+	}
+	h := sha1.Sum(append([]byte(req.Method+" "+req.URL.Path+"\n"), bs...))
+	name := recordingNameChars.ReplaceAllString(req.Method+"_"+req.URL.Path, "_")
+	return filepath.Join(r.Root, name+"_"+hex.EncodeToString(h[:8])), nil
+}
+
+func (r *Recording) Get(k string, req *http.Request) (*http.Response, error) {
+	if r.Update {
+		return nil, os.ErrNotExist
+	}
+	bs, err := os.ReadFile(k)
+	if err != nil {
+		return nil, err
+	}
+	line, rest, _ := bytes.Cut(bs, []byte("\n"))
+	fs := strings.Fields(string(line))
+	if len(fs) != 3 {
+		return nil, fmt.Errorf("invalid recording %q: expected `METHOD PATH BODY_LENGTH` line", k)
+	} else if n, err := strconv.Atoi(fs[2]); err != nil || n+1 > len(rest) {
+		return nil, fmt.Errorf("invalid recording %q: bad body length %q", k, fs[2])
+	} else {
+		rest = rest[n+1:]
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(rest)), req)
+}
+
+func (r *Recording) Set(k string, req *http.Request, res *http.Response) error {
+	body, err := r.body(req)
+	if err != nil {
+		return err
+	}
+	h := res.Header
+	res.Header = h.Clone()
+	for _, k := range recordingSkipHeaders {
+		res.Header.Del(k)
+	}
+	bs, err := httputil.DumpResponse(res, true)
+	res.Header = h
+	if err != nil {
+		return err
+	}
+	indented := &bytes.Buffer{}
+	if json.Indent(indented, body, "", "  ") != nil {
+		indented = bytes.NewBuffer(body)
+	}
+	bs = append(fmt.Appendf(nil, "%s %s %d\n%s\n", req.Method, req.URL.Path, indented.Len(), indented), bs...)
+	return errors.Join(os.MkdirAll(r.Root, 0755), os.WriteFile(k, bs, 0644))
+}
+
+// body returns the normalized request body. Set is called after the request has been sent,
+// i.e. req.Body has been consumed, so GetBody is preferred
+func (r *Recording) body(req *http.Request) ([]byte, error) {
+	body := req.Body
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	} else if body == nil {
+		return nil, nil
+	}
+	bs, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	body.Close()
+	if req.GetBody == nil {
+		req.Body = io.NopCloser(bytes.NewReader(bs))
+	}
+	m := map[string]any{}
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return bs, nil
+	}
+	delete(m, "model")
+	return json.Marshal(m)
+}
@@ -0,0 +1,151 @@
+//go:build goexperiment.jsonv2
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/niklasfasching/x/ai"
+	"github.com/niklasfasching/x/sq"
+)
+
+type Store struct {
+	*sq.Table[Conversation]
+}
+
+type Conversation struct {
+	ID                   string `sq:"PRIMARY KEY"`
+	Parent               string
+	System               string
+	Model                string
+	MaxTokens            int
+	Temperature          float64
+	Budget               int
+	Concurrency          int
+	Streaming            bool
+	Usage                ai.Usage
+	Messages             []ai.Message
+	CreatedAt, UpdatedAt time.Time `sq:"AUTO"`
+}
+
+const table = "Conversations"
+
+var cols = []string{"ID", "Parent", "Model", "CreatedAt", "UpdatedAt"}
+
+// Schema returns the migration for the conversations table
+func Schema() string {
+	return sq.Schema(Conversation{})
+}
+
+func New(db *sq.DB) *Store {
+	return &Store{sq.NewTable[Conversation](db, table, "ID")}
+}
+
+// Save creates or updates conversation id with the state of ch
+func (s *Store) Save(ctx context.Context, id string, ch *ai.Chat) error {
+	c := Conversation{
+		ID: id, System: ch.System, Model: ch.Model, MaxTokens: ch.MaxTokens,
+		Temperature: ch.Temperature, Budget: ch.Budget, Concurrency: ch.Concurrency,
+		Streaming: ch.Streaming, Usage: ch.Usage, Messages: ch.Messages,
+	}
+	return s.TxImmediate(ctx, func(tx *sq.Tx) error {
+		t := s.In(tx)
+		if n, err := t.CountContext(ctx, "ID = ?", id); err != nil {
+			return fmt.Errorf("save %q: %w", id, err)
+		} else if n == 0 {
+			_, err := t.InsertContext(ctx, "", c)
+			return err
+		}
+		return t.UpdateContext(ctx, c, "System", "Model", "MaxTokens", "Temperature",
+			"Budget", "Concurrency", "Streaming", "Usage", "Messages")
+	})
+}
+
+// AutoSave saves ch as id after every response
+func (s *Store) AutoSave(id string, ch *ai.Chat) {
+	f := ch.OnResponse
+	ch.OnResponse = func(r *ai.Response) {
+		if f != nil {
+			f(r)
+		}
+		if err := s.Save(context.Background(), id, ch); err != nil {
+			log.Printf("ERROR: autosave %q: %v", id, err)
+		}
+	}
+}
+
+// Load rehydrates conversation id. Tool calls of an incomplete last turn are dropped
+// so that Loop can continue from the last complete turn.
+func (s *Store) Load(ctx context.Context, id string, c *ai.Client, tools []ai.Tool) (*ai.Chat, error) {
+	v, err := s.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	cl := *c
+	if v.Model != "" {
+		cl.Model = v.Model
+	}
+	return &ai.Chat{
+		Client: &cl, System: v.System, Messages: complete(v.Messages), Tools: tools,
+		MaxTokens: v.MaxTokens, Temperature: v.Temperature, Budget: v.Budget,
+		Concurrency: v.Concurrency, Streaming: v.Streaming, Usage: v.Usage,
+	}, nil
+}
+
+// List returns all conversations without their messages, most recently updated first
+func (s *Store) List(ctx context.Context) ([]Conversation, error) {
+	return sq.QueryContext[Conversation](ctx, s.DB, `SELECT {cols "cols"} FROM {'table} ORDER BY UpdatedAt DESC`,
+		sq.Args{"cols": cols, "table": table})
+}
+
+// Fork copies the first n messages (all if n < 0) of conversation id into newID
+func (s *Store) Fork(ctx context.Context, id, newID string, n int) error {
+	v, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	v.ID, v.Parent, v.Messages = newID, id, head(v.Messages, n)
+	v.CreatedAt, v.UpdatedAt = time.Time{}, time.Time{}
+	_, err = s.InsertContext(ctx, "", v)
+	return err
+}
+
+// Truncate drops all but the first n messages of conversation id
+func (s *Store) Truncate(ctx context.Context, id string, n int) error {
+	return s.ModifyContext(ctx, id, func(v *Conversation) error {
+		v.Messages = head(v.Messages, n)
+		return nil
+	}, "Messages")
+}
+
+func (s *Store) get(ctx context.Context, id string) (Conversation, error) {
+	v, err := sq.QueryOneContext[Conversation](ctx, s.DB, "SELECT * FROM "+table+" WHERE ID = ?", id)
+	if err != nil {
+		return v, fmt.Errorf("conversation %q: %w", id, err)
+	}
+	return v, nil
+}
+
+func head(ms []ai.Message, n int) []ai.Message {
+	if n >= 0 && n < len(ms) {
+		ms = ms[:n]
+	}
+	return complete(ms)
+}
+
+// complete drops a trailing assistant message with unanswered tool calls
+func complete(ms []ai.Message) []ai.Message {
+	if len(ms) == 0 {
+		return ms
+	} else if m := ms[len(ms)-1]; m.Role == "assistant" {
+		blks, _ := m.Content.([]ai.Block)
+		if slices.ContainsFunc(blks, func(b ai.Block) bool { return b.Type == "tool_use" }) {
+			return ms[:len(ms)-1]
+		}
+	}
+	return ms
+}
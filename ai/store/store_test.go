@@ -0,0 +1,98 @@
+//go:build goexperiment.jsonv2
+
+package store
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/niklasfasching/x/ai"
+	"github.com/niklasfasching/x/sq"
+)
+
+func TestStore(t *testing.T) {
+	db, err := sq.New(filepath.Join(t.TempDir(), "db.sqlite"), []string{Schema()}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, c := New(db), &ai.Client{URL: "http://localhost", Model: "model"}
+	ch := ai.NewChat(c, "system", nil, "replace 'world' with 'universe'")
+	ch.MaxTokens, ch.Concurrency, ch.Usage = 100, 4, ai.Usage{InputTokens: 10, OutputTokens: 5}
+	ch.Messages = append(ch.Messages,
+		ai.Message{Role: "assistant", Content: []ai.Block{
+			{Type: "text", Text: "Let me edit that."},
+			{Type: "tool_use", ID: "toolu_01", Name: "edit", Input: json.RawMessage(`{"path":"test.txt"}`)},
+		}},
+		ai.Message{Role: "user", Content: []ai.Block{
+			{Type: "tool_result", ToolUseID: "toolu_01", Content: "success"},
+		}},
+		ai.Message{Role: "assistant", Content: []ai.Block{
+			{Type: "tool_use", ID: "toolu_02", Name: "edit", Input: json.RawMessage(`{"path":"test.txt"}`)},
+		}},
+	)
+	if err := s.Save(t.Context(), "a", ch); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	ch.System = "updated system"
+	if err := s.Save(t.Context(), "a", ch); err != nil {
+		t.Fatalf("save existing: %v", err)
+	}
+
+	loaded, err := s.Load(t.Context(), "a", c, nil)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	} else if loaded.System != "updated system" || loaded.MaxTokens != 100 || loaded.Concurrency != 4 ||
+		loaded.Usage != ch.Usage || loaded.Model != "model" {
+		t.Fatalf("got %#v", loaded)
+	} else if len(loaded.Messages) != 3 {
+		t.Fatalf("got %d messages, want incomplete last turn dropped", len(loaded.Messages))
+	} else if loaded.Messages[0].Content != "replace 'world' with 'universe'" {
+		t.Fatalf("got first message %#v", loaded.Messages[0])
+	} else if blks := loaded.Messages[1].Content.([]ai.Block); blks[1].ID != "toolu_01" ||
+		string(blks[1].Input) != `{"path":"test.txt"}` {
+		t.Fatalf("got tool_use %#v", blks)
+	} else if blks := loaded.Messages[2].Content.([]ai.Block); blks[0].ToolUseID != "toolu_01" ||
+		blks[0].Content != "success" {
+		t.Fatalf("got tool_result %#v", blks)
+	}
+
+	if err := s.Fork(t.Context(), "a", "b", 2); err != nil {
+		t.Fatalf("fork: %v", err)
+	} else if forked, err := s.Load(t.Context(), "b", c, nil); err != nil {
+		t.Fatalf("load fork: %v", err)
+	} else if len(forked.Messages) != 1 || forked.System != "updated system" {
+		t.Fatalf("got fork %#v", forked)
+	}
+	if err := s.Truncate(t.Context(), "a", 1); err != nil {
+		t.Fatalf("truncate: %v", err)
+	} else if truncated, err := s.Load(t.Context(), "a", c, nil); err != nil || len(truncated.Messages) != 1 {
+		t.Fatalf("got %v %#v", err, truncated)
+	}
+
+	cs, err := s.List(t.Context())
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	} else if len(cs) != 2 || cs[0].Messages != nil || cs[1].Messages != nil {
+		t.Fatalf("got %#v", cs)
+	} else if i := slices.IndexFunc(cs, func(c Conversation) bool { return c.ID == "b" }); cs[i].Parent != "a" {
+		t.Fatalf("got fork without parent: %#v", cs[i])
+	}
+	if _, err := s.Load(t.Context(), "missing", c, nil); err == nil {
+		t.Fatalf("expected error for missing conversation")
+	}
+	wg, errs := sync.WaitGroup{}, make(chan error, 8)
+	for range cap(errs) {
+		wg.Go(func() { errs <- s.Save(t.Context(), "concurrent", ch) })
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent save: %v", err)
+		}
+	}
+}
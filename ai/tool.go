@@ -0,0 +1,255 @@
+package ai
+
+import (
+	"context"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// schema is the subset of JSON schema generated by NewTool
+type schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	AdditionalProperties any                `json:"additionalProperties,omitempty"`
+}
+
+var textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+
+// NewTool returns a Tool with a schema generated from In. Fields are named by their json tag;
+// pointer and omitempty fields are optional. The desc and enum (comma separated) tags
+// describe and restrict fields (the elements of slice fields). Invalid input is reported to the model without calling f.
+func NewTool[In any](name, desc string, f func(context.Context, In) (string, error)) Tool {
+	s := schemaOf(reflect.TypeFor[In](), map[reflect.Type]bool{})
+	bs, err := json.Marshal(s)
+	if err != nil {
+		panic(fmt.Errorf("tool %q: %w", name, err))
+	}
+	return Tool{Name: name, Description: desc, Schema: bs,
+		Handler: func(ctx context.Context, raw json.RawMessage) (string, Block, error) {
+			v, err := decode[In](s, raw)
+			if err != nil {
+				return "", Block{}, err
+			}
+			out, err := f(ctx, v)
+			return out, Block{}, err
+		},
+	}
+}
+
+// Extract asks the model to answer input by calling a tool whose schema is generated from T
+// (see NewTool) and returns the decoded tool input. Non-object types are wrapped as {"value": T}.
+// Invalid input is reported back to the model and retried up to retries times.
+func Extract[T any](ctx context.Context, ch *Chat, input any, retries int) (T, error) {
+	s := schemaOf(reflect.TypeFor[T](), map[reflect.Type]bool{})
+	extract := func(raw json.RawMessage) (T, error) { return decode[T](s, raw) }
+	if s.Type != "object" {
+		ws := &schema{Type: "object", Properties: map[string]*schema{"value": s}, Required: []string{"value"}, AdditionalProperties: false}
+		s, extract = ws, func(raw json.RawMessage) (T, error) {
+			w, err := decode[struct {
+				Value T `json:"value"`
+			}](ws, raw)
+			return w.Value, err
+		}
+	}
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return *new(T), fmt.Errorf("extract: %w", err)
+	}
+	tools, choice := ch.Tools, ch.ToolChoice
+	ch.Tools, ch.ToolChoice = []Tool{{Name: "extract", Description: "Report the result", Schema: bs}}, "extract"
+	defer func() { ch.Tools, ch.ToolChoice = tools, choice }()
+	for i := 0; ; i++ {
+		r, err := ch.Send(ctx, input)
+		if err != nil {
+			return *new(T), err
+		}
+		v, rblks := *new(T), []Block{}
+		err = fmt.Errorf("no call of tool extract (stop reason %q)", r.StopReason)
+		input = "Call the extract tool with the result."
+		for _, b := range r.Content {
+			if b.Type != "tool_use" {
+				continue
+			} else if len(rblks) != 0 {
+				rblks = append(rblks, Block{Type: "tool_result", ToolUseID: b.ID,
+					Content: "only the first extract call is used", IsError: true})
+				continue
+			}
+			v, err = extract(b.Input)
+			rblks = append(rblks, Block{Type: "tool_result", ToolUseID: b.ID, Content: "ok", IsError: err != nil})
+			if err != nil {
+				rblks[0].Content = err.Error()
+			}
+		}
+		if len(rblks) != 0 {
+			input = rblks
+		}
+		if err != nil && i < retries {
+			continue
+		} else if len(rblks) != 0 {
+			ch.Messages = append(ch.Messages, Message{Role: "user", Content: rblks})
+		}
+		if err != nil {
+			return v, fmt.Errorf("extract: %w", err)
+		}
+		return v, nil
+	}
+}
+
+func decode[T any](s *schema, raw json.RawMessage) (T, error) {
+	v, x := *new(T), any(nil)
+	if err := json.Unmarshal(raw, &x); err != nil {
+		return v, fmt.Errorf("invalid input: %w", err)
+	} else if err := s.validate(x, "input"); err != nil {
+		return v, fmt.Errorf("invalid input: %w", err)
+	} else if err := json.Unmarshal(raw, &v); err != nil {
+		return v, fmt.Errorf("invalid input: %w", err)
+	}
+	return v, nil
+}
+
+func schemaOf(t reflect.Type, seen map[reflect.Type]bool) *schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeFor[time.Time]() {
+		return &schema{Type: "string", Format: "date-time"}
+	} else if reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return &schema{Type: "string"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &schema{Type: "string", Format: "byte"}
+		}
+		return &schema{Type: "array", Items: schemaOf(t.Elem(), seen)}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return &schema{} // recursive types are left unconstrained
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		s := &schema{Type: "object", Properties: map[string]*schema{}, Required: []string{}, AdditionalProperties: false}
+		s.addFields(t, seen)
+		return s
+	}
+	return &schema{}
+}
+
+func (s *schema) addFields(t reflect.Type, seen map[reflect.Type]bool) {
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		} else if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.addFields(f.Type, seen)
+			continue
+		}
+		fs := schemaOf(f.Type, seen)
+		fs.Description = f.Tag.Get("desc")
+		if enum := f.Tag.Get("enum"); enum != "" {
+			es := fs
+			for es.Type == "array" && es.Items != nil {
+				es = es.Items
+			}
+			for _, v := range strings.Split(enum, ",") {
+				if x := any(nil); es.Type != "string" && json.Unmarshal([]byte(v), &x) == nil {
+					es.Enum = append(es.Enum, x)
+				} else {
+					es.Enum = append(es.Enum, v)
+				}
+			}
+		}
+		if name == "" {
+			name = f.Name
+		}
+		s.Properties[name] = fs
+		if f.Type.Kind() != reflect.Pointer && !slices.Contains(strings.Split(opts, ","), "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+func (s *schema) validate(v any, path string) error {
+	if len(s.Enum) != 0 && !slices.ContainsFunc(s.Enum, func(x any) bool { return fmt.Sprint(x) == fmt.Sprint(v) }) {
+		return fmt.Errorf("%s: %v is not one of %v", path, v, s.Enum)
+	} else if v == nil && s.Type != "" {
+		return fmt.Errorf("%s: expected %s, got null", path, s.Type)
+	}
+	switch v := v.(type) {
+	case string:
+		if s.Type != "" && s.Type != "string" {
+			return fmt.Errorf("%s: expected %s, got string", path, s.Type)
+		} else if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, v); err != nil {
+				return fmt.Errorf("%s: expected RFC3339 date-time: %w", path, err)
+			}
+		}
+	case bool:
+		if s.Type != "" && s.Type != "boolean" {
+			return fmt.Errorf("%s: expected %s, got boolean", path, s.Type)
+		}
+	case float64:
+		if s.Type != "" && s.Type != "number" && (s.Type != "integer" || v != math.Trunc(v)) {
+			return fmt.Errorf("%s: expected %s, got number %v", path, s.Type, v)
+		}
+	case []any:
+		if s.Type != "" && s.Type != "array" {
+			return fmt.Errorf("%s: expected %s, got array", path, s.Type)
+		}
+		for i, x := range v {
+			if s.Items == nil {
+				break
+			} else if err := s.Items.validate(x, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		if s.Type != "" && s.Type != "object" {
+			return fmt.Errorf("%s: expected %s, got object", path, s.Type)
+		}
+		for _, k := range s.Required {
+			if _, ok := v[k]; !ok {
+				return fmt.Errorf("%s: missing required field %q", path, k)
+			}
+		}
+		for k, x := range v {
+			if ps, ok := s.Properties[k]; ok && x == nil && !slices.Contains(s.Required, k) {
+				continue
+			} else if ok {
+				if err := ps.validate(x, path+"."+k); err != nil {
+					return err
+				}
+			} else if as, ok := s.AdditionalProperties.(*schema); ok {
+				if err := as.validate(x, path+"."+k); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties == false {
+				return fmt.Errorf("%s: unknown field %q", path, k)
+			}
+		}
+	}
+	return nil
+}
@@ -1,10 +1,11 @@
 package cli
 
 import (
+	"context"
+	"encoding"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -12,63 +13,72 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type API map[string]CMD
 
+// CMD is either a command (F) or a group of commands (Sub). Flags of a group are a pointer to a
+// struct that is parsed before and inherited by all commands of the group, e.g. `tool db --path x migrate`
+// and `tool db migrate --path x` are equivalent. A group with F calls F if no sub command is given.
+// Config is the path of a JSON (.json) or JML file with flag fallbacks for the command and its sub commands.
+// Completers complete the values of flags (by "--name") and args (by field name) of the command and its sub commands.
+// Prompt enables prompting for missing required args and flags of the command and its sub commands if stdin is a terminal.
 type CMD struct {
-	F         interface{}
-	Complete  func([]string) []string
-	Desc, Doc string
+	F          interface{}
+	Complete   func([]string) []string
+	Desc, Doc  string
+	Sub        API
+	Flags      interface{}
+	Config     string
+	Completers map[string]func([]string) []string
+	Prompt     bool
 }
 
 var kebabCaseRegexp = regexp.MustCompile(`([a-z]+)([A-Z]+)`)
 
 func (a API) Run(cmd string, args []string) error {
+	return a.RunContext(context.Background(), cmd, args)
+}
+
+// RunContext is like Run but passes ctx to commands that take a context
+func (a API) RunContext(ctx context.Context, cmd string, args []string) error {
 	if cmd == "shell-complete" {
 		return a.complete(args)
-	} else if c, ok := a[cmd]; ok {
-		return c.call(cmd, args)
-	}
-	return a.usage(cmd)
-}
-
-func (a API) complete(args []string) error {
-	log.SetOutput(os.Stdout)
-	if len(args) == 0 {
-		script := fmt.Sprintf(`
-          function _complete_%[1]s() {
-              local current="${COMP_WORDS[COMP_CWORD]}"
-              local args="${COMP_WORDS[@]:1:$COMP_CWORD}"
-              COMPREPLY=( $(compgen -W "$(%[1]s shell-complete "$args")" -- "$current") )
-          }
-          complete -F _complete_%[1]s -o default %[1]s`, os.Args[0])
-		log.Println(script)
-	} else if args = strings.Split(args[0], " "); len(args) <= 1 {
-		for name := range a {
-			if a[name].Desc != "-" {
-				log.Println(name)
-			}
-		}
-	} else if cmd, ok := a[args[0]]; !ok {
-		return nil
-	} else if current := args[len(args)-1]; strings.HasPrefix(current, "-") {
-		if t := reflect.TypeOf(cmd.F); t.NumIn() == 3 {
-			ft := t.In(2)
-			for i, n := 0, ft.NumField(); i < n; i++ {
-				log.Println("--" + kebabCase(ft.Field(i).Name))
-			}
-		}
-	} else if cmd.Complete != nil {
-		log.Println(strings.Join(cmd.Complete(args), " "))
 	}
-	return nil
+	return a.run(scope{ctx: ctx, prompter: terminalPrompter()}, cmd, args)
 }
 
-func (a API) usage(cmd string) error {
-	exe, cmds, s := filepath.Base(os.Args[0]), []string{}, ""
-	if cmd != "" {
-		s += "Unknown command: " + cmd + "\n"
+func (a API) run(s scope, cmd string, args []string) error {
+	c, ok := a[cmd]
+	if !ok && cmd == "" {
+		return a.usage(s, nil)
+	} else if !ok {
+		return a.usage(s, fmt.Errorf("Unknown command: %s", cmd))
+	}
+	s, err := s.enter(cmd, c)
+	if err != nil {
+		return err
+	} else if c.Sub == nil {
+		return c.call(s, args)
+	}
+	fs, err := flagSet(s.groups...)
+	if err != nil {
+		return err
+	} else if err := fs.Parse(args); err != nil {
+		return c.Sub.usage(s, err)
+	} else if args = fs.Args(); len(args) == 0 && c.F != nil {
+		return c.call(s, args)
+	} else if len(args) == 0 {
+		return c.Sub.usage(s, nil)
+	}
+	return c.Sub.run(s, args[0], args[1:])
+}
+
+func (a API) usage(sc scope, err error) error {
+	exe, cmds, s := strings.Join(append([]string{filepath.Base(os.Args[0])}, sc.path...), " "), []string{}, ""
+	if err != nil && err != flag.ErrHelp {
+		s += err.Error() + "\n"
 	}
 	s += fmt.Sprintf("Usage: %s [Command] [Flags] [Args]\n", exe)
 	for c := range a {
@@ -84,80 +94,159 @@ func (a API) usage(cmd string) error {
 			}
 		}
 	}
-	return fmt.Errorf("%s", s)
+	if len(sc.groups) != 0 {
+		s += "Flags:" + sc.flagUsage(sc.groups)
+	}
+	return &UsageError{s, err}
+}
+
+// signature returns the types of the args and flags structs of F (nil if F does not take them)
+// and whether F takes a context
+func (c CMD) signature() (at, ft reflect.Type, withContext bool, err error) {
+	t, in := reflect.TypeOf(c.F), []reflect.Type{}
+	for i := 0; t != nil && t.Kind() == reflect.Func && i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+	if len(in) != 0 && in[0] == contextType {
+		in, withContext = in[1:], true
+	}
+	if len(in) == 0 || len(in) > 3 || in[0].Kind() != reflect.String || t.NumOut() != 1 || t.Out(0) != errorType {
+		return nil, nil, false, fmt.Errorf("f must be of type func(?ctx, cmd, ?args, ?flags) error")
+	} else if len(in) >= 2 {
+		at = in[1]
+	}
+	if len(in) == 3 {
+		ft = in[2]
+	}
+	return at, ft, withContext, nil
 }
 
-func (c CMD) call(cmd string, args []string) error {
-	ft, cv := reflect.TypeOf(c.F), reflect.ValueOf(cmd)
+func (c CMD) call(s scope, args []string) error {
+	at, ft, withContext, err := c.signature()
+	if err != nil {
+		return err
+	}
 	av, fv := reflect.ValueOf(struct{}{}), reflect.ValueOf(struct{}{})
-	switch ft.NumIn() {
-	case 3:
-		av, fv = reflect.New(ft.In(1)).Elem(), reflect.New(ft.In(2)).Elem()
-	case 2:
-		av = reflect.New(ft.In(1)).Elem()
-	case 1:
-	default:
-		return fmt.Errorf("f must be of type func(cmd, ?args, ?flags)")
+	vs := []reflect.Value{reflect.ValueOf(s.path[len(s.path)-1])}
+	if withContext {
+		vs = append([]reflect.Value{reflect.ValueOf(s.context())}, vs...)
+	}
+	if at != nil {
+		av = reflect.New(at).Elem()
+		vs = append(vs, av)
 	}
-	args, err := c.parseFlags(fv, args)
+	if ft != nil {
+		fv = reflect.New(ft).Elem()
+		vs = append(vs, fv)
+	}
+	args, err = c.parseFlags(s, fv, args)
 	if err != nil {
-		return c.usage(cmd, err)
+		return c.usage(s, err)
+	}
+	if err := s.requireFlags(append([]reflect.Value{fv}, s.groups...)); err != nil {
+		return c.usage(s, err)
 	}
-	if err := c.parseArgs(av, args); err != nil {
-		return c.usage(cmd, err)
+	if err := c.parseArgs(s, av, args); err != nil {
+		return c.usage(s, err)
 	}
-	vs := []reflect.Value{cv, av, fv}
-	v := reflect.ValueOf(c.F).Call(vs[:ft.NumIn()])[0].Interface()
+	v := reflect.ValueOf(c.F).Call(vs)[0].Interface()
 	if v == nil {
 		return nil
 	}
 	return v.(error)
 }
 
-func (c CMD) parseFlags(fv reflect.Value, args []string) ([]string, error) {
-	fs, ft := flag.NewFlagSet("", 0), fv.Type()
-	fs.SetOutput(io.Discard)
-	n := ft.NumField()
-	for i := 0; i < n; i++ {
-		ft, v := ft.Field(i), fv.Field(i).Addr().Interface()
-		name := kebabCase(ft.Name)
-		parts := splitTag(ft)
-		usage, fallback := parts[0], ""
-		if len(parts) == 2 {
-			fallback = parts[1]
+// parseFlags parses the flags of the command (fv) and all inherited group flags. Group flags
+// already have their defaults (and values parsed at the group level) set.
+func (c CMD) parseFlags(s scope, fv reflect.Value, args []string) ([]string, error) {
+	if err := s.setDefaults(fv); err != nil {
+		return nil, err
+	}
+	fs, err := flagSet(append([]reflect.Value{fv}, s.groups...)...)
+	if err != nil {
+		return nil, err
+	}
+	err = fs.Parse(args)
+	return fs.Args(), err
+}
+
+// requireFlags returns an error for required flags of fvs that are still zero after flags, env, config and
+// defaults were applied - or prompts for them (see scope.prompt)
+func (s scope) requireFlags(fvs []reflect.Value) error {
+	for _, fv := range fvs {
+		for i, n := 0, fv.NumField(); i < n; i++ {
+			f, v := fv.Type().Field(i), fv.Field(i)
+			if !parseTag(f).required || !v.IsZero() {
+				continue
+			} else if p := s.prompt(); p != nil {
+				if err := p.ask("--"+kebabCase(f.Name), f, v); err != nil {
+					return err
+				}
+			} else {
+				return fmt.Errorf("missing required flag --%s", kebabCase(f.Name))
+			}
 		}
-		switch ft.Type.Kind() {
-		case reflect.String:
-			fs.StringVar(v.(*string), name, fallback, usage)
-		case reflect.Int:
-			i, err := strconv.Atoi(fallback)
-			if err != nil {
-				return nil, fmt.Errorf("could not parse fallback '%v' as int", fallback)
+	}
+	return nil
+}
+
+// flagSet returns a flag set for the fields of the flags structs fvs; their current values are the defaults
+func flagSet(fvs ...reflect.Value) (*flag.FlagSet, error) {
+	fs := flag.NewFlagSet("", 0)
+	fs.SetOutput(io.Discard)
+	for _, fv := range fvs {
+		ft := fv.Type()
+		for i, n := 0, ft.NumField(); i < n; i++ {
+			ft, v := ft.Field(i), fv.Field(i)
+			name, usage := kebabCase(ft.Name), parseTag(ft).usage
+			if fs.Lookup(name) != nil {
+				return nil, fmt.Errorf("flag --%s is defined more than once", name)
+			} else if !isSupported(v.Type()) {
+				return nil, fmt.Errorf("%T flags are not supported", v.Interface())
 			}
-			fs.IntVar(v.(*int), name, i, usage)
-		case reflect.Bool:
-			fs.BoolVar(v.(*bool), name, fallback == "true", usage)
-		default:
-			return nil, fmt.Errorf("%T flags are not supported", fv.Field(i).Interface())
+			fs.Var(&value{v: v, enum: parseTag(ft).enum}, name, usage)
 		}
 	}
-	err := fs.Parse(args)
-	return fs.Args(), err
+	return fs, nil
 }
 
-func (c CMD) parseArgs(va reflect.Value, args []string) error {
+// parseArgs sets the fields of va to args. A trailing slice field is variadic and takes all remaining args.
+// Missing args fall back like flags (see scope.resolve); those without fallback are prompted for (see scope.prompt).
+func (c CMD) parseArgs(s scope, va reflect.Value, args []string) error {
 	at := va.Type()
 	n := at.NumField()
-	if m := len(args); m > n {
+	variadic := n != 0 && isVariadic(at.Field(n-1).Type)
+	if m := len(args); m > n && !variadic {
 		return fmt.Errorf("expected %d arguments but got %d", n, m)
 	}
 	for i := 0; i < n; i++ {
-		ft := at.Field(i)
-		tvs := splitTag(ft)
-		if i < len(args) {
-			va.Field(i).SetString(args[i])
-		} else if isOptional := len(tvs) == 2; isOptional {
-			va.Field(i).SetString(tvs[0])
+		ft, v, isVariadic := at.Field(i), va.Field(i), i == n-1 && variadic
+		if !isSupported(ft.Type) {
+			return fmt.Errorf("%T args are not supported", v.Interface())
+		} else if i < len(args) {
+			vs, tag := args[i:i+1], parseTag(ft)
+			if isVariadic {
+				vs = args[i:]
+			}
+			for _, arg := range vs {
+				if err := tag.check(arg); err != nil {
+					return fmt.Errorf("invalid argument <%s>: %w", ft.Name, err)
+				} else if err := set(v, arg); err != nil {
+					return fmt.Errorf("invalid argument <%s>: %w", ft.Name, err)
+				}
+			}
+		} else if vs, src, err := s.resolve(ft); err != nil {
+			return fmt.Errorf("argument <%s>: %w", ft.Name, err)
+		} else if len(vs) != 0 || isVariadic {
+			for _, x := range vs {
+				if err := set(v, x); err != nil {
+					return fmt.Errorf("invalid fallback for argument <%s> (%s): %w", ft.Name, src, err)
+				}
+			}
+		} else if p := s.prompt(); p != nil {
+			if err := p.ask("<"+ft.Name+">", ft, v); err != nil {
+				return err
+			}
 		} else {
 			return fmt.Errorf("missing required argument <%s>", ft.Name)
 		}
@@ -165,64 +254,207 @@ func (c CMD) parseArgs(va reflect.Value, args []string) error {
 	return nil
 }
 
-func (c CMD) usage(cmd string, err error) error {
-	exe := filepath.Base(os.Args[0])
-	s, ft := "", reflect.TypeOf(c.F)
-	sx := fmt.Sprintf("Usage: %s %s ", exe, cmd)
+// value is a flag.Value for struct fields of all types supported by set.
+// Repeated slice and map flags accumulate; the first one replaces the fallback.
+type value struct {
+	v    reflect.Value
+	set  bool
+	enum []string
+}
+
+func (v *value) String() string {
+	if !v.v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.v.Interface())
+}
+
+func (v *value) Set(s string) error {
+	if !v.set && (isVariadic(v.v.Type()) || v.v.Kind() == reflect.Map && !isCustom(v.v.Type())) {
+		v.v.SetZero()
+	}
+	v.set = true
+	if err := (tag{enum: v.enum}).check(s); err != nil {
+		return err
+	}
+	return set(v.v, s)
+}
+
+func (v *value) IsBoolFlag() bool { return v.v.Kind() == reflect.Bool }
+
+var (
+	flagValueType       = reflect.TypeOf((*flag.Value)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	durationType        = reflect.TypeOf(time.Duration(0))
+	contextType         = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType           = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// isCustom returns whether t is parsed by its own flag.Value or encoding.TextUnmarshaler implementation
+func isCustom(t reflect.Type) bool {
+	return reflect.PointerTo(t).Implements(flagValueType) || reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+func isVariadic(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && !isCustom(t)
+}
+
+func isSupported(t reflect.Type) bool {
+	if isCustom(t) || t == durationType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return isSupported(t.Elem())
+	case reflect.Map:
+		return isSupported(t.Key()) && isSupported(t.Elem())
+	}
+	return false
+}
+
+// set parses s into v. Slices are appended to and maps take k=v pairs.
+func set(v reflect.Value, s string) error {
+	if p := v.Addr().Interface(); isCustom(v.Type()) {
+		if fv, ok := p.(flag.Value); ok {
+			return fv.Set(s)
+		}
+		return p.(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	} else if v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		v.SetInt(int64(d))
+		return err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		i, err := strconv.ParseUint(s, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		x := reflect.New(v.Type().Elem()).Elem()
+		if err := set(x, s); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, x))
+	case reflect.Map:
+		ks, vs, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("expected key=value, got %q", s)
+		}
+		k, x := reflect.New(v.Type().Key()).Elem(), reflect.New(v.Type().Elem()).Elem()
+		if err := set(k, ks); err != nil {
+			return err
+		} else if err := set(x, vs); err != nil {
+			return err
+		} else if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(k, x)
+	default:
+		return fmt.Errorf("%s is not supported", v.Type())
+	}
+	return nil
+}
+
+func (c CMD) usage(sc scope, err error) error {
+	exe, groups := filepath.Base(os.Args[0]), sc.groups
+	s, at, ft := "", reflect.Type(nil), reflect.Type(nil)
+	if c.F != nil {
+		at, ft, _, _ = c.signature()
+	}
+	sx := fmt.Sprintf("Usage: %s %s ", exe, strings.Join(sc.path, " "))
 	if err != nil && err != flag.ErrHelp {
 		sx = fmt.Sprintf("Error:  %s\n", err) + sx
 	}
-	if ft.NumIn() == 3 {
-		t := ft.In(2)
-		s += "  Flags:"
+	if ft != nil {
+		groups = append([]reflect.Value{reflect.New(ft).Elem()}, groups...)
+	}
+	if len(groups) != 0 {
+		s += "  Flags:" + sc.flagUsage(groups)
 		sx += "[Flags] "
-		for i, n := 0, t.NumField(); i < n; i++ {
-			s += fieldUsage(t.Field(i), func(name string, tag []string) string {
-				return "--" + kebabCase(name)
-			})
-		}
 	}
-	if ft.NumIn() >= 2 {
-		t := ft.In(1)
+	if t := at; t != nil {
 		s += "  Args:"
 		for i, n := 0, t.NumField(); i < n; i++ {
-			s += fieldUsage(t.Field(i), func(name string, tag []string) string {
-				if len(tag) == 2 {
-					sx += "<?" + name + "> "
-				} else {
-					sx += "<" + name + "> "
-				}
-				return name
-			})
+			f, fallback := t.Field(i), ""
+			if tag := parseTag(f); tag.hasFallback {
+				fallback = fmt.Sprintf(" :: %#v", tag.fallback)
+			}
+			sx += argName(f, i == n-1) + " "
+			s += fieldUsage(f, f.Name, fallback)
 		}
 	}
 	if c.Doc != "" {
 		s += "Docs:\n  " + strings.ReplaceAll(strings.TrimSpace(c.Doc), "\n", "\n  ")
 	}
-	return fmt.Errorf("%s\n%s", sx, s)
+	return &UsageError{sx + "\n" + s, err}
 }
 
-func fieldUsage(f reflect.StructField, nameify func(string, []string) string) string {
-	tag := splitTag(f)
-	s := fmt.Sprintf("\n    %s", nameify(f.Name, tag))
-	if len(tag) == 2 {
-		s += fmt.Sprintf("  (%s :: %#v)", f.Type, tag[0])
-	} else {
-		s += fmt.Sprintf("  (%s)", f.Type)
-	}
-	if len(tag) >= 1 {
-		s += fmt.Sprintf("  %s\n", tag[0])
+// flagUsage lists the flags of fvs with their resolved fallbacks and where they come from
+func (sc scope) flagUsage(fvs []reflect.Value) string {
+	s := ""
+	for _, fv := range fvs {
+		for i, n := 0, fv.NumField(); i < n; i++ {
+			f, fallback := fv.Type().Field(i), ""
+			vs, src, _ := sc.resolve(f)
+			if parseTag(f).secret && src != "" && src != "default" {
+				vs = []string{"***"}
+			}
+			if src == "default" {
+				fallback = fmt.Sprintf(" :: %#v", strings.Join(vs, ","))
+			} else if src != "" {
+				fallback = fmt.Sprintf(" :: %#v from %s", strings.Join(vs, ","), src)
+			}
+			s += fieldUsage(f, "--"+kebabCase(f.Name), fallback)
+		}
 	}
 	return s
 }
 
-func splitTag(t reflect.StructField) []string {
-	vs := strings.SplitN(t.Tag.Get("cli"), "::", 2)
-	for i, v := range vs {
-		vs[i] = strings.TrimSpace(v)
+// argName returns the name of the positional arg f as shown in usage: <Name>, <?Optional> or <Variadic...>
+func argName(f reflect.StructField, last bool) string {
+	if last && isVariadic(f.Type) {
+		return "<" + f.Name + "...>"
+	} else if parseTag(f).hasFallback {
+		return "<?" + f.Name + ">"
+	}
+	return "<" + f.Name + ">"
+}
+
+func fieldUsage(f reflect.StructField, name, fallback string) string {
+	t := parseTag(f)
+	if len(t.enum) != 0 {
+		t.usage = strings.TrimSpace(t.usage + " (" + strings.Join(t.enum, "|") + ")")
+	}
+	if t.required {
+		t.usage = strings.TrimSpace(t.usage + " (required)")
 	}
-	sort.Sort(sort.StringSlice(vs))
-	return vs
+	return fmt.Sprintf("\n    %s  (%s%s)  %s\n", name, f.Type, fallback, t.usage)
 }
 
 func kebabCase(s string) string {
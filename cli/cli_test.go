@@ -0,0 +1,332 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.jml")
+	if err := os.WriteFile(config, []byte("db:\n  timeout: \"3s\"\nlabels:\n  a: 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLI_TEST_DB", "env.db")
+	type flags struct {
+		Ratio float64
+		Tag   []string `cli:"tags::a,b"`
+		Addr  netip.Addr
+	}
+	db, out := struct {
+		Path    string            `cli:"db path::x.db::env=CLI_TEST_DB"`
+		User    string            `cli:"db user::root::env=CLI_TEST_UNSET"`
+		Timeout time.Duration     `cli:"timeout::5s::config=db.timeout"`
+		Labels  map[string]string `cli:"labels::::config"`
+	}{}, ""
+	api := API{
+		"run": {F: func(cmd string, a struct {
+			Port  int
+			Files []string
+		}, f flags) error {
+			out = fmt.Sprintf("%s %v %v", cmd, a, f)
+			return nil
+		}},
+		"db": {Flags: &db, Config: config, Sub: API{
+			"migrate": {F: func(cmd string, a struct{ Version int }, f struct {
+				DryRun bool
+				Format string `cli:"::::enum=json,text"`
+			}) error {
+				out = fmt.Sprintf("%s %v %v", cmd, db, f.DryRun)
+				return nil
+			}, Completers: map[string]func([]string) []string{
+				"Version": func([]string) []string { return []string{"1\tone", "2"} },
+			}},
+		}},
+	}
+	for _, c := range []struct {
+		args     []string
+		out, err string
+	}{
+		{[]string{"run", "--ratio", "0.5", "--tag", "x", "--tag", "y", "--addr", "::1", "80", "a", "b"}, "run {80 [a b]} {0.5 [x y] ::1}", ""},
+		{[]string{"run", "80"}, "run {80 []} {0 [a b] invalid IP}", ""},
+		{[]string{"run", "x"}, "", "invalid argument <Port>"},
+		{[]string{"db", "migrate", "--dry-run", "1"}, "migrate {env.db root 3s map[a:1]} true", ""},
+		{[]string{"db", "--path", "flag.db", "migrate", "1"}, "migrate {flag.db root 3s map[a:1]} false", ""},
+		{[]string{"db", "migrate", "--labels", "b=2", "1"}, "migrate {env.db root 3s map[b:2]} false", ""},
+		{[]string{"db", "migrate", "-h"}, "", `--timeout  (time.Duration :: "3s" from config db.timeout)`},
+		{[]string{"db", "-h"}, "", `--path  (string :: "env.db" from $CLI_TEST_DB)`},
+		{[]string{"db", "foo"}, "", "Unknown command: foo"},
+		{[]string{"db", "migrate", "--format", "xml", "1"}, "", `"xml" is not one of json, text`},
+	} {
+		out = ""
+		err := api.Run(c.args[0], c.args[1:])
+		if c.err == "" && err != nil {
+			t.Fatalf("%v: unexpected error %v", c.args, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%v: got error %v, want %q", c.args, err, c.err)
+		} else if out != c.out {
+			t.Fatalf("%v: got %q, want %q", c.args, out, c.out)
+		}
+	}
+	for _, c := range []struct{ args, want string }{
+		{"", "[{db } {run }]"},
+		{"db --path x ", "[{migrate }]"},
+		{"db migrate --", "[{--dry-run } {--format } {--path db path} {--user db user} {--timeout timeout} {--labels labels}]"},
+		{"db migrate --format ", "[{json } {text }]"},
+		{"db migrate --format=t", "[{--format=text }]"},
+		{"db migrate --dry-run ", "[{1 one} {2 }]"},
+		{"run --ratio 1 80 x", "[]"},
+	} {
+		if got := fmt.Sprint(api.completions(strings.Split(c.args, " "), scope{})); got != c.want {
+			t.Fatalf("%q: got completions %s, want %s", c.args, got, c.want)
+		}
+	}
+}
+
+func TestFlagTypes(t *testing.T) {
+	type flags struct {
+		Timeout time.Duration     `cli:"timeout::1m"`
+		Port    uint16            `cli:"port::8080"`
+		Ratio   float32           `cli:"ratio::0.5"`
+		Tags    []string          `cli:"tags::a,b"`
+		Limits  map[string]int    `cli:"limits::cpu=1,mem=2"`
+		Level   string            `cli:"level::info::enum=debug,info"`
+		Out     string            `cli:"output file::out.txt::file=*.txt"`
+		Net     netip.Prefix      `cli:"network::10.0.0.0/8"`
+		Headers map[string]string `cli:"headers"`
+		Mode    string            `cli:"mode::required"`
+	}
+	out := ""
+	api := API{"cmd": {F: func(cmd string, a struct {
+		Sizes []int `cli:"sizes::3,4::env=CLI_TEST_SIZES"`
+	}, f flags) error {
+		out = fmt.Sprintf("%v %v", a, f)
+		return nil
+	}}}
+	for _, c := range []struct{ args, out, err string }{
+		{"", "{[3 4]} {1m0s 8080 0.5 [a b] map[cpu:1 mem:2] info out.txt 10.0.0.0/8 map[] required}", ""},
+		{"--timeout 1h30m --port 0x10 --ratio 2 1 2", "{[1 2]} {1h30m0s 16 2 [a b] map[cpu:1 mem:2] info out.txt 10.0.0.0/8 map[] required}", ""},
+		{"--tags x --tags y --limits cpu=4 --headers a=b=c", "{[3 4]} {1m0s 8080 0.5 [x y] map[cpu:4] info out.txt 10.0.0.0/8 map[a:b=c] required}", ""},
+		{"--level debug --net 192.168.0.0/16 --mode x", "{[3 4]} {1m0s 8080 0.5 [a b] map[cpu:1 mem:2] debug out.txt 192.168.0.0/16 map[] x}", ""},
+		{"--timeout 1", "", "invalid value \"1\" for flag -timeout"},
+		{"--port 65536", "", "invalid value \"65536\" for flag -port"},
+		{"--limits cpu", "", "expected key=value"},
+		{"--level warn", "", `"warn" is not one of debug, info`},
+		{"x", "", "invalid argument <Sizes>"},
+	} {
+		out = ""
+		err := api.Run("cmd", strings.Fields(c.args))
+		if c.err == "" && err != nil {
+			t.Fatalf("%q: unexpected error %v", c.args, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%q: got error %v, want %q", c.args, err, c.err)
+		} else if out != c.out {
+			t.Fatalf("%q: got %q, want %q", c.args, out, c.out)
+		}
+	}
+	t.Setenv("CLI_TEST_SIZES", "5,6")
+	if err := api.Run("cmd", nil); err != nil || !strings.HasPrefix(out, "{[5 6]}") {
+		t.Fatalf("expected variadic arg from env: %q %v", out, err)
+	}
+
+	type tags struct {
+		Port  uint16 `cli:"port::8080"`
+		Level string `cli:"level::info::enum=debug,info"`
+		Out   string `cli:"output file::out.txt::file=*.txt"`
+		Mode  string `cli:"mode::secret"`
+		Token string `cli:"api token::::env::required::secret"`
+		Name  string `cli:"name::"`
+	}
+	ft := reflect.TypeOf(tags{})
+	for name, want := range map[string]tag{
+		"Port":  {usage: "port", fallback: "8080", hasFallback: true},
+		"Level": {usage: "level", fallback: "info", hasFallback: true, enum: []string{"debug", "info"}},
+		"Out":   {usage: "output file", fallback: "out.txt", hasFallback: true, file: "*.txt", isFile: true},
+		"Mode":  {usage: "mode", fallback: "secret", hasFallback: true},
+		"Token": {usage: "api token", env: "Token", required: true, secret: true},
+		"Name":  {usage: "name"},
+	} {
+		if f, _ := ft.FieldByName(name); !reflect.DeepEqual(parseTag(f), want) {
+			t.Fatalf("%s: got tag %#v, want %#v (usage::default by position)", name, parseTag(f), want)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	db, user, out := struct {
+		Path string `cli:"db path::x.db"`
+	}{}, struct {
+		Role string `cli:"role::viewer"`
+	}{}, ""
+	api := API{"db": {Flags: &db, Sub: API{
+		"user": {Flags: &user, F: func(cmd string) error {
+			out = fmt.Sprintf("%s %s %s", cmd, db.Path, user.Role)
+			return nil
+		}, Sub: API{
+			"add": {F: func(cmd string, a struct{ Name string }, f struct{ Admin bool }) error {
+				out = fmt.Sprintf("%s %s %s %s %v", cmd, db.Path, user.Role, a.Name, f.Admin)
+				return nil
+			}},
+			"dup": {F: func(cmd string, a struct{}, f struct{ Path string }) error { return nil }},
+		}},
+	}}}
+	for _, c := range []struct{ args, out, err string }{
+		{"db user add bob", "add x.db viewer bob false", ""},
+		{"db --path a user --role admin add --admin bob", "add a admin bob true", ""},
+		{"db user add --path a --role admin bob", "add a admin bob false", ""},
+		{"db --path a user --path b add --path c bob", "add c viewer bob false", ""},
+		{"db --path a user", "user a viewer", ""},
+		{"db user --path a", "user a viewer", ""},
+		{"db --role admin user", "", "flag provided but not defined: -role"},
+		{"db user dup", "", "flag --path is defined more than once"},
+	} {
+		out = ""
+		args := strings.Fields(c.args)
+		err := api.Run(args[0], args[1:])
+		if c.err == "" && err != nil {
+			t.Fatalf("%q: unexpected error %v", c.args, err)
+		} else if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%q: got error %v, want %q", c.args, err, c.err)
+		} else if out != c.out {
+			t.Fatalf("%q: got %q, want %q", c.args, out, c.out)
+		}
+	}
+}
+
+func TestDocs(t *testing.T) {
+	db := struct {
+		Path string `cli:"db path::x.db::env=DB_PATH"`
+	}{}
+	api := API{
+		"hello": {Desc: "Say hello", Doc: ".not a macro", F: func(cmd string, a struct {
+			Name string `cli:"who::world"`
+		}) error {
+			return nil
+		}},
+		"db": {Flags: &db, Sub: API{
+			"migrate": {F: func(cmd string, a struct{ Files []string }, f struct {
+				Format string `cli:"output::json::enum=json,text"`
+			}) error {
+				return nil
+			}},
+		}},
+	}
+	md, err := api.Docs("markdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"## db migrate\n", "db migrate [Flags] <Files...>\n",
+		"| `--format` | `string` | `json` | output (one of json, text) |\n| `--path` | `string` | `x.db` | db path (env DB_PATH) |",
+		"## hello\n\nSay hello\n", "| `Name` | `string` | `world` | who |"} {
+		if !strings.Contains(md, want) {
+			t.Fatalf("markdown does not contain %q:\n%s", want, md)
+		}
+	}
+	man, err := api.Docs("man")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{".SS db migrate\n", ".B \\-\\-format\n\\fIstring\\fR (default: json)\n", "\\&.not a macro"} {
+		if !strings.Contains(man, want) {
+			t.Fatalf("man page does not contain %q:\n%s", want, man)
+		}
+	}
+	if _, err := api.Docs("html"); err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	type key struct{}
+	api := API{
+		"ctx": {F: func(ctx context.Context, cmd string, a struct {
+			Code int `cli:"exit code::0"`
+		}) error {
+			if ctx.Value(key{}) != "v" {
+				return fmt.Errorf("missing context")
+			} else if a.Code != 0 {
+				return &ExitError{Code: a.Code}
+			}
+			return ctx.Err()
+		}},
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(t.Context(), key{}, "v"))
+	defer cancel()
+	interrupted := make(chan os.Signal, 1)
+	for _, c := range []struct {
+		args []string
+		sig  chan os.Signal
+		code int
+		out  string
+	}{
+		{[]string{"ctx"}, nil, 0, ""},
+		{[]string{"ctx", "3"}, nil, 3, ""},
+		{[]string{"ctx", "-h"}, nil, 0, "Usage: "},
+		{[]string{"ctx", "x"}, nil, 2, "Error:  invalid argument <Code>"},
+		{[]string{"nope"}, nil, 2, "Unknown command: nope"},
+		{[]string{"ctx"}, interrupted, 130, ""},
+	} {
+		if c.sig != nil {
+			cancel()
+			c.sig <- os.Interrupt
+		}
+		out := &strings.Builder{}
+		if code := exitCode(api.RunContext(ctx, c.args[0], c.args[1:]), c.sig, out, out); code != c.code {
+			t.Fatalf("%v: got exit code %d, want %d", c.args, code, c.code)
+		} else if !strings.HasPrefix(out.String(), c.out) {
+			t.Fatalf("%v: got output %q, want %q", c.args, out, c.out)
+		}
+	}
+}
+
+func TestPrompt(t *testing.T) {
+	type flags struct {
+		Token string `cli:"api token::::env=CLI_TEST_UNSET::required::secret"`
+		Mode  string `cli:"::fast::enum=fast,slow"`
+	}
+	out := ""
+	api := API{"cmd": {Prompt: true, F: func(cmd string, a struct {
+		Name   string
+		Level  string `cli:"::::enum=debug,info"`
+		Format string `cli:"::text"`
+	}, f flags) error {
+		out = fmt.Sprintf("%v %v", a, f)
+		return nil
+	}}}
+	for _, x := range []struct {
+		args, in, secret, out, prompt, err string
+		strict                             bool
+	}{
+		{"--token t x info", "", "", "{x info text} {t fast}", "", "", false},
+		{"--token t x", "2\n", "", "{x info text} {t fast}", "  1) debug\n  2) info\n<Level>: ", "", false},
+		{"--token t", "\n", "", "", "<Name>: invalid <Name>: a value is required\n<Name>: ", "EOF", false},
+		{"--token t bob", "warn\n1\n", "", "{bob debug text} {t fast}", "<Level>: invalid <Level>", "", false},
+		{"x debug", "", "s3cret", "{x debug text} {s3cret fast}", "--token (api token): ", "", false},
+		{"x debug", "", "", "", "", "missing required flag --token", true},
+		{"--token t", "", "", "", "", "missing required argument <Name>", true},
+	} {
+		out = ""
+		s, w := scope{}, &strings.Builder{}
+		s.prompter = &prompter{bufio.NewReader(strings.NewReader(x.in)), w, func() (string, error) { return x.secret, nil }}
+		if x.strict {
+			api["cmd"] = CMD{F: api["cmd"].F}
+		}
+		err := api.run(s, "cmd", strings.Fields(x.args))
+		if x.err == "" && err != nil {
+			t.Fatalf("%q: unexpected error %v", x.args, err)
+		} else if x.err != "" && (err == nil || !strings.Contains(err.Error(), x.err)) {
+			t.Fatalf("%q: got error %v, want %q", x.args, err, x.err)
+		} else if out != x.out {
+			t.Fatalf("%q: got %q, want %q", x.args, out, x.out)
+		} else if !strings.Contains(w.String(), x.prompt) || (x.prompt == "" && w.Len() != 0) {
+			t.Fatalf("%q: got prompt %q, want %q", x.args, w.String(), x.prompt)
+		}
+	}
+}
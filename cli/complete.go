@@ -0,0 +1,210 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type candidate struct{ value, desc string }
+
+var completionScripts = map[string]string{
+	"bash": `
+          function _complete_%[1]s() {
+              local IFS=$'\n'
+              COMPREPLY=( $(%[2]s shell-complete -- "${COMP_WORDS[@]:1:$COMP_CWORD}" | cut -f1) )
+          }
+          complete -F _complete_%[1]s -o default %[2]s`,
+	"zsh": `
+          function _complete_%[1]s() {
+              local -a candidates
+              candidates=("${(@f)$(%[2]s shell-complete -- "${(@)words[2,CURRENT]}")}")
+              candidates=("${(@)candidates//:/\\:}")
+              candidates=("${(@)candidates/$'\t'/:}")
+              if [[ -n "${candidates[1]}" ]]; then _describe 'values' candidates; else _files; fi
+          }
+          compdef _complete_%[1]s %[2]s`,
+	"fish": `
+          function _complete_%[1]s
+              set -l candidates (%[2]s shell-complete -- (commandline -opc)[2..-1] (commandline -ct))
+              if test (count $candidates) -eq 0
+                  __fish_complete_path (commandline -ct)
+              else
+                  printf '%%s\n' $candidates
+              end
+          end
+          complete -c %[2]s -f -a '(_complete_%[1]s)'`,
+}
+
+// complete prints the completion script for bash (default), zsh or fish or, for `shell-complete -- words...`,
+// the candidates (and descriptions, tab separated) for the last word. The single argument form
+// `shell-complete "words..."` used by old bash scripts prints only the candidates.
+func (a API) complete(args []string) error {
+	log.SetOutput(os.Stdout)
+	log.SetFlags(0)
+	exe := filepath.Base(os.Args[0])
+	if len(args) == 0 {
+		args = []string{"bash"}
+	}
+	if script, ok := completionScripts[args[0]]; ok && len(args) == 1 {
+		log.Println(fmt.Sprintf(script, strings.NewReplacer("-", "_", ".", "_").Replace(exe), exe))
+	} else if args[0] == "--" {
+		words := args[1:]
+		if len(words) == 0 {
+			words = []string{""}
+		}
+		for _, c := range a.completions(words, scope{}) {
+			if c.desc != "" {
+				log.Println(c.value + "\t" + strings.ReplaceAll(c.desc, "\n", " "))
+			} else {
+				log.Println(c.value)
+			}
+		}
+	} else {
+		for _, c := range a.completions(strings.Split(args[0], " "), scope{}) {
+			log.Println(c.value)
+		}
+	}
+	return nil
+}
+
+// completions returns the candidates for the last of args, i.e. the word being completed.
+func (a API) completions(args []string, s scope) []candidate {
+	current := args[len(args)-1]
+	if len(args) == 1 {
+		cs := []candidate{}
+		for name, c := range a {
+			if c.Desc != "-" {
+				cs = append(cs, candidate{name, c.Desc})
+			}
+		}
+		sort.Slice(cs, func(i, j int) bool { return cs[i].value < cs[j].value })
+		return filter(cs, current)
+	}
+	c, ok := a[args[0]]
+	if !ok {
+		return nil
+	}
+	s, err := s.enter(args[0], c)
+	if err != nil {
+		return nil
+	}
+	fvs, words := s.groups, args[1:len(args)-1]
+	at, ft, _, _ := c.signature()
+	if c.Sub == nil && ft != nil {
+		fvs = append([]reflect.Value{reflect.New(ft).Elem()}, fvs...)
+	}
+	fs, err := flagSet(fvs...)
+	if err != nil {
+		return nil
+	}
+	perr := fs.Parse(words)
+	rest := fs.Args()
+	if c.Sub != nil && perr == nil && len(rest) != 0 {
+		return c.Sub.completions(append(rest, current), s)
+	} else if name, v, ok := strings.Cut(current, "="); ok && strings.HasPrefix(name, "-") {
+		f, ok := findFlag(fvs, name)
+		if !ok {
+			return nil
+		}
+		cs := s.fieldCompletions(f, "--"+kebabCase(f.Name), append(args[:len(args)-1:len(args)-1], v))
+		for i := range cs {
+			cs[i].value = name + "=" + cs[i].value
+		}
+		return cs
+	} else if n := len(words); n != 0 && strings.HasPrefix(words[n-1], "-") && !strings.Contains(words[n-1], "=") {
+		if f, ok := findFlag(fvs, words[n-1]); ok && f.Type.Kind() != reflect.Bool {
+			return s.fieldCompletions(f, "--"+kebabCase(f.Name), args)
+		}
+	}
+	if strings.HasPrefix(current, "-") {
+		cs := []candidate{}
+		for _, fv := range fvs {
+			for i, n := 0, fv.NumField(); i < n; i++ {
+				f := fv.Type().Field(i)
+				cs = append(cs, candidate{"--" + kebabCase(f.Name), parseTag(f).usage})
+			}
+		}
+		return filter(cs, current)
+	} else if perr != nil {
+		return nil
+	} else if c.Sub != nil {
+		return c.Sub.completions([]string{current}, s)
+	} else if at != nil && at.NumField() != 0 {
+		f := at.Field(min(len(rest), at.NumField()-1))
+		if len(rest) < at.NumField() || isVariadic(f.Type) {
+			if cs := s.fieldCompletions(f, f.Name, args); cs != nil {
+				return cs
+			}
+		}
+	}
+	if c.Complete != nil {
+		return filter(candidates(c.Complete(args)), current)
+	}
+	return nil
+}
+
+// fieldCompletions returns the candidates for the value of the flag or arg f from the completer
+// registered for key, its enum or the file system
+func (s scope) fieldCompletions(f reflect.StructField, key string, args []string) []candidate {
+	current := args[len(args)-1]
+	if complete := s.completers[key]; complete != nil {
+		return filter(candidates(complete(args)), current)
+	} else if t := parseTag(f); len(t.enum) != 0 {
+		return filter(candidates(t.enum), current)
+	} else if t.isFile {
+		return files(current, t.file)
+	}
+	return nil
+}
+
+func findFlag(fvs []reflect.Value, name string) (reflect.StructField, bool) {
+	for _, fv := range fvs {
+		for i, n := 0, fv.NumField(); i < n; i++ {
+			if f := fv.Type().Field(i); "--"+kebabCase(f.Name) == name || "-"+kebabCase(f.Name) == name {
+				return f, true
+			}
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// files returns the directories and the files matching pattern (if any) starting with current
+func files(current, pattern string) []candidate {
+	ms, _ := filepath.Glob(current + "*")
+	cs := []candidate{}
+	for _, m := range ms {
+		if strings.HasPrefix(filepath.Base(m), ".") && !strings.HasPrefix(filepath.Base(current), ".") {
+			continue
+		} else if fi, err := os.Stat(m); err == nil && fi.IsDir() {
+			cs = append(cs, candidate{m + "/", ""})
+		} else if ok, _ := filepath.Match(pattern, filepath.Base(m)); pattern == "" || ok {
+			cs = append(cs, candidate{m, ""})
+		}
+	}
+	return cs
+}
+
+// candidates splits "value\tdescription" strings
+func candidates(vs []string) []candidate {
+	cs := []candidate{}
+	for _, v := range vs {
+		v, desc, _ := strings.Cut(v, "\t")
+		cs = append(cs, candidate{v, desc})
+	}
+	return cs
+}
+
+func filter(cs []candidate, prefix string) []candidate {
+	out := []candidate{}
+	for _, c := range cs {
+		if strings.HasPrefix(c.value, prefix) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
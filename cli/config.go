@@ -0,0 +1,215 @@
+package cli
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/niklasfasching/x/format/jml"
+)
+
+// scope is the state inherited from the groups a command is nested in
+type scope struct {
+	ctx         context.Context
+	path        []string
+	groups      []reflect.Value // flags structs of the groups
+	config      map[string]any  // contents of the innermost CMD.Config
+	completers  map[string]func([]string) []string
+	prompter    *prompter // reads from stdin if it's a terminal (see terminalPrompter)
+	interactive bool      // whether a CMD on the path enabled Prompt
+}
+
+func (s scope) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// tag is the parsed cli tag of a field: `cli:"usage::default::env=NAME::config=key::enum=a,b::file=*.go::required::secret"`.
+// The parts are positional up to the default, i.e. fields without default leave it empty (`usage::::required`).
+// A bare env (config) uses the field name (kebab cased field name) as env var (config key).
+// enum restricts and completes values; file completes values as paths (matching the optional pattern).
+// required flags must not be zero; secret values are not shown in usage and read without echo when prompted.
+type tag struct {
+	usage, fallback, env, key, file       string
+	hasFallback, isFile, required, secret bool
+	enum                                  []string
+}
+
+func parseTag(f reflect.StructField) tag {
+	vs := strings.Split(f.Tag.Get("cli"), "::")
+	t := tag{usage: strings.TrimSpace(vs[0])}
+	if len(vs) > 1 {
+		t.fallback = strings.TrimSpace(vs[1])
+		t.hasFallback = t.fallback != ""
+	}
+	for _, v := range vs[min(2, len(vs)):] {
+		switch k, x, _ := strings.Cut(strings.TrimSpace(v), "="); k {
+		case "env":
+			t.env = cmp.Or(x, f.Name)
+		case "config":
+			t.key = cmp.Or(x, kebabCase(f.Name))
+		case "enum":
+			t.enum = strings.Split(x, ",")
+		case "file":
+			t.file, t.isFile = x, true
+		case "required":
+			t.required = true
+		case "secret":
+			t.secret = true
+		}
+	}
+	return t
+}
+
+func (t tag) check(v string) error {
+	if len(t.enum) != 0 && !slices.Contains(t.enum, v) {
+		return fmt.Errorf("%q is not one of %s", v, strings.Join(t.enum, ", "))
+	}
+	return nil
+}
+
+// enter returns the scope of the sub command c named cmd and sets the fallbacks of its group flags
+func (s scope) enter(cmd string, c CMD) (scope, error) {
+	s.path, s.interactive = append(s.path[:len(s.path):len(s.path)], cmd), s.interactive || c.Prompt
+	if c.Completers != nil {
+		s.completers = maps.Clone(s.completers)
+		if s.completers == nil {
+			s.completers = map[string]func([]string) []string{}
+		}
+		maps.Copy(s.completers, c.Completers)
+	}
+	if c.Config != "" {
+		m, err := loadConfig(os.ExpandEnv(c.Config))
+		if err != nil {
+			return s, err
+		}
+		s.config = m
+	}
+	if c.Flags != nil {
+		if v := reflect.ValueOf(c.Flags); v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+			return s, fmt.Errorf("%s: Flags must be a pointer to a struct", strings.Join(s.path, " "))
+		} else if err := s.setDefaults(v.Elem()); err != nil {
+			return s, err
+		}
+		s.groups = append(s.groups[:len(s.groups):len(s.groups)], reflect.ValueOf(c.Flags).Elem())
+	}
+	return s, nil
+}
+
+// setDefaults sets the fields of the flags struct fv to their fallbacks (see resolve)
+func (s scope) setDefaults(fv reflect.Value) error {
+	ft := fv.Type()
+	for i, n := 0, ft.NumField(); i < n; i++ {
+		vs, src, err := s.resolve(ft.Field(i))
+		if err != nil {
+			return err
+		}
+		v := fv.Field(i)
+		v.SetZero()
+		for _, x := range vs {
+			if err := set(v, x); err != nil {
+				return fmt.Errorf("could not parse fallback '%v' of --%s (%s): %w", x, kebabCase(ft.Field(i).Name), src, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve returns the fallback of the flag f and its source: The env var, then the config key, then the default.
+// Comma separated env vars and defaults (config lists and objects) are split into multiple values for slices and maps.
+func (s scope) resolve(f reflect.StructField) ([]string, string, error) {
+	t, split := parseTag(f), func(v string) []string { return []string{v} }
+	if isVariadic(f.Type) || f.Type.Kind() == reflect.Map && !isCustom(f.Type) {
+		split = func(v string) []string { return strings.Split(v, ",") }
+	}
+	if v, ok := os.LookupEnv(t.env); ok && t.env != "" {
+		return split(v), "$" + t.env, nil
+	} else if x, ok := lookup(s.config, t.key); ok && t.key != "" {
+		vs, err := configValues(x)
+		if err != nil {
+			return nil, "", fmt.Errorf("config %s: %w", t.key, err)
+		}
+		return vs, "config " + t.key, nil
+	} else if t.fallback != "" {
+		return split(t.fallback), "default", nil
+	}
+	return nil, "", nil
+}
+
+func loadConfig(path string) (map[string]any, error) {
+	bs, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := map[string]any{}
+	if filepath.Ext(path) == ".json" {
+		err = json.Unmarshal(bs, &m)
+	} else {
+		err = jml.Unmarshal(bs, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// lookup returns the value of the dot separated key in m
+func lookup(m map[string]any, key string) (any, bool) {
+	x := any(m)
+	for _, k := range strings.Split(key, ".") {
+		m, ok := x.(map[string]any)
+		if !ok {
+			return nil, false
+		} else if x, ok = m[k]; !ok {
+			return nil, false
+		}
+	}
+	return x, true
+}
+
+// configValues returns x as values for set; lists are flattened and objects become k=v pairs
+func configValues(x any) ([]string, error) {
+	switch x := x.(type) {
+	case string:
+		return []string{x}, nil
+	case []any:
+		vs := []string{}
+		for _, x := range x {
+			v, err := configValues(x)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, v...)
+		}
+		return vs, nil
+	case map[string]any:
+		vs := []string{}
+		for k, x := range x {
+			v, err := configValues(x)
+			if err != nil {
+				return nil, err
+			} else if len(v) != 1 {
+				return nil, fmt.Errorf("%s: expected a scalar value", k)
+			}
+			vs = append(vs, k+"="+v[0])
+		}
+		sort.Strings(vs)
+		return vs, nil
+	default:
+		bs, err := json.Marshal(x)
+		return []string{string(bs)}, err
+	}
+}
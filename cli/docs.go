@@ -0,0 +1,163 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type doc struct {
+	path                []string
+	synopsis, desc, doc string
+	flags, args         []docField
+}
+
+type docField struct{ name, typ, fallback, usage string }
+
+// Docs renders a reference of all commands with their flags and args as "man" (troff) page or "markdown"
+func (a API) Docs(format string) (string, error) {
+	exe, ds := filepath.Base(os.Args[0]), a.docs(nil, nil, nil)
+	switch format {
+	case "man":
+		return manDocs(exe, ds), nil
+	case "markdown", "md":
+		return markdownDocs(exe, ds), nil
+	}
+	return "", fmt.Errorf("unknown docs format %q: must be man or markdown", format)
+}
+
+func (a API) docs(path []string, groups []reflect.Type, ds []doc) []doc {
+	names := []string{}
+	for name := range a {
+		if a[name].Desc != "-" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c, p, gs := a[name], append(path[:len(path):len(path)], name), groups
+		if c.Flags != nil {
+			gs = append(gs[:len(gs):len(gs)], reflect.TypeOf(c.Flags).Elem())
+		}
+		d := doc{path: p, desc: c.Desc, doc: strings.TrimSpace(c.Doc)}
+		fts, synopsis := gs, []string{}
+		at, ft, _, _ := c.signature()
+		if ft != nil {
+			fts = append([]reflect.Type{ft}, gs...)
+		}
+		for _, t := range fts {
+			for i, n := 0, t.NumField(); i < n; i++ {
+				d.flags = append(d.flags, newDocField(t.Field(i), "--"+kebabCase(t.Field(i).Name), true))
+			}
+		}
+		if len(d.flags) != 0 {
+			synopsis = append(synopsis, "[Flags]")
+		}
+		if c.Sub != nil {
+			synopsis = append(synopsis, "<Command>")
+		} else if t := at; t != nil {
+			for i, n := 0, t.NumField(); i < n; i++ {
+				synopsis = append(synopsis, argName(t.Field(i), i == n-1))
+				d.args = append(d.args, newDocField(t.Field(i), t.Field(i).Name, false))
+			}
+		}
+		d.synopsis = strings.Join(synopsis, " ")
+		ds = append(ds, d)
+		if c.Sub != nil {
+			ds = c.Sub.docs(p, gs, ds)
+		}
+	}
+	return ds
+}
+
+func newDocField(f reflect.StructField, name string, isFlag bool) docField {
+	t, notes := parseTag(f), []string{}
+	if t.required {
+		notes = append(notes, "required")
+	}
+	if len(t.enum) != 0 {
+		notes = append(notes, "one of "+strings.Join(t.enum, ", "))
+	}
+	if isFlag && t.env != "" {
+		notes = append(notes, "env "+t.env)
+	}
+	if isFlag && t.key != "" {
+		notes = append(notes, "config "+t.key)
+	}
+	if len(notes) != 0 {
+		t.usage = strings.TrimSpace(t.usage + " (" + strings.Join(notes, "; ") + ")")
+	}
+	return docField{name, f.Type.String(), t.fallback, t.usage}
+}
+
+func markdownDocs(exe string, ds []doc) string {
+	w := &strings.Builder{}
+	fmt.Fprintf(w, "# %s\n\n", exe)
+	for _, d := range ds {
+		cmd := strings.Join(append([]string{exe}, d.path...), " ")
+		fmt.Fprintf(w, "## %s\n\n", strings.Join(d.path, " "))
+		if d.desc != "" {
+			fmt.Fprintf(w, "%s\n\n", d.desc)
+		}
+		fmt.Fprintf(w, "```\n%s\n```\n\n", strings.TrimSpace(cmd+" "+d.synopsis))
+		if d.doc != "" {
+			fmt.Fprintf(w, "%s\n\n", d.doc)
+		}
+		for _, x := range []struct {
+			title  string
+			fields []docField
+		}{{"Flag", d.flags}, {"Arg", d.args}} {
+			if len(x.fields) == 0 {
+				continue
+			}
+			fmt.Fprintf(w, "| %s | Type | Default | Description |\n| --- | --- | --- | --- |\n", x.title)
+			for _, f := range x.fields {
+				fallback := ""
+				if f.fallback != "" {
+					fallback = "`" + f.fallback + "`"
+				}
+				fmt.Fprintf(w, "| `%s` | `%s` | %s | %s |\n", f.name, f.typ, fallback, strings.ReplaceAll(f.usage, "|", `\|`))
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+	return strings.TrimSpace(w.String()) + "\n"
+}
+
+func manDocs(exe string, ds []doc) string {
+	w := &strings.Builder{}
+	fmt.Fprintf(w, ".TH %s 1\n.SH NAME\n%s\n.SH SYNOPSIS\n.B %s\n<Command> [Flags] [Args]\n.SH COMMANDS\n",
+		strings.ToUpper(troff(exe)), troff(exe), troff(exe))
+	for _, d := range ds {
+		fmt.Fprintf(w, ".SS %s\n.B %s\n%s\n", troff(strings.Join(d.path, " ")),
+			troff(strings.Join(append([]string{exe}, d.path...), " ")), troff(d.synopsis))
+		for _, s := range []string{d.desc, d.doc} {
+			if s != "" {
+				fmt.Fprintf(w, ".PP\n%s\n", troff(s))
+			}
+		}
+		for _, f := range append(d.flags, d.args...) {
+			fmt.Fprintf(w, ".TP\n.B %s\n\\fI%s\\fR", troff(f.name), troff(f.typ))
+			if f.fallback != "" {
+				fmt.Fprintf(w, " (default: %s)", troff(f.fallback))
+			}
+			fmt.Fprintf(w, "\n%s\n", troff(f.usage))
+		}
+	}
+	return w.String()
+}
+
+// troff escapes s for use as man page text
+func troff(s string) string {
+	s = strings.NewReplacer(`\`, `\e`, "-", `\-`).Replace(s)
+	lines := strings.Split(s, "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(l, ".") || strings.HasPrefix(l, "'") {
+			lines[i] = `\&` + l
+		}
+	}
+	return strings.Join(lines, "\n")
+}
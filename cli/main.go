@@ -0,0 +1,97 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ExitError makes Main exit with Code
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+// UsageError is returned for unknown commands and invalid flags or args. Its message is the usage text
+// (including Err); Err is flag.ErrHelp if usage was requested via -h/--help.
+type UsageError struct {
+	Usage string
+	Err   error
+}
+
+// GracePeriod is the time Main gives a command to return after its context was cancelled by a signal.
+// A second signal exits immediately.
+var GracePeriod = 10 * time.Second
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error { return e.Err }
+
+func (e *UsageError) Error() string { return e.Usage }
+
+func (e *UsageError) Unwrap() error { return e.Err }
+
+// Main runs the command os.Args[1] with a context that is cancelled on SIGINT and SIGTERM and exits.
+// See exitCode for exit codes.
+func (a API) Main() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs, sig := make(chan os.Signal, 2), make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		sig <- s
+		cancel()
+		select {
+		case <-sigs:
+		case <-time.After(GracePeriod):
+		}
+		fmt.Fprintf(os.Stderr, "%s: forced exit\n", s)
+		os.Exit(128 + int(s.(syscall.Signal)))
+	}()
+	cmd, args := "", []string{}
+	if len(os.Args) > 1 {
+		cmd, args = os.Args[1], os.Args[2:]
+	}
+	os.Exit(exitCode(a.RunContext(ctx, cmd, args), sig, os.Stdout, os.Stderr))
+}
+
+// exitCode prints err and returns the exit code for it: 0 for nil and requested usage, ExitError.Code,
+// 2 for usage errors, 128+signal if the command was interrupted and 1 otherwise.
+func exitCode(err error, sig chan os.Signal, stdout, stderr io.Writer) int {
+	exitErr, usageErr := &ExitError{}, &UsageError{}
+	if err == nil {
+		return 0
+	} else if errors.As(err, &usageErr) && errors.Is(usageErr.Err, flag.ErrHelp) {
+		fmt.Fprintln(stdout, usageErr.Usage)
+		return 0
+	} else if errors.As(err, &usageErr) {
+		fmt.Fprintln(stderr, usageErr.Usage)
+		return 2
+	}
+	select {
+	case s := <-sig:
+		if errors.Is(err, context.Canceled) {
+			return 128 + int(s.(syscall.Signal))
+		}
+	default:
+	}
+	if !errors.As(err, &exitErr) {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+		return 1
+	} else if exitErr.Err != nil {
+		fmt.Fprintf(stderr, "Error: %s\n", err)
+	}
+	return exitErr.Code
+}
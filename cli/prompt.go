@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// prompter asks for missing required args and flags of commands that opt in via CMD.Prompt.
+// Commands only prompt if stdin is a terminal; otherwise missing values are usage errors.
+type prompter struct {
+	r      *bufio.Reader
+	w      io.Writer
+	secret func() (string, error) // reads a line without echoing it
+}
+
+// prompt returns the prompter of s if a command on its path enabled prompting (nil otherwise)
+func (s scope) prompt() *prompter {
+	if !s.interactive {
+		return nil
+	}
+	return s.prompter
+}
+
+func terminalPrompter() *prompter {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil
+	}
+	return &prompter{bufio.NewReader(os.Stdin), os.Stderr, func() (string, error) {
+		bs, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(bs), err
+	}}
+}
+
+// ask prompts for the value of the flag or arg f named name and sets v until a valid value is entered.
+// Enum values can be chosen by their number; an empty answer selects the fallback.
+func (p *prompter) ask(name string, f reflect.StructField, v reflect.Value) error {
+	t, label := parseTag(f), name
+	if t.usage != "" {
+		label += " (" + t.usage + ")"
+	}
+	for i, x := range t.enum {
+		fmt.Fprintf(p.w, "  %d) %s\n", i+1, x)
+	}
+	if t.fallback != "" && !t.secret {
+		label += " [" + t.fallback + "]"
+	}
+	for {
+		fmt.Fprintf(p.w, "%s: ", label)
+		s, err := p.read(t.secret)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if s = strings.TrimSpace(s); s == "" {
+			s = t.fallback
+		} else if i, err := strconv.Atoi(s); err == nil && t.check(s) != nil && i >= 1 && i <= len(t.enum) {
+			s = t.enum[i-1]
+		}
+		vs := []string{s}
+		if isVariadic(f.Type) {
+			vs = strings.Fields(s)
+		}
+		if err = nil; s == "" && !t.hasFallback {
+			err = errors.New("a value is required")
+		}
+		v.SetZero()
+		for _, x := range vs {
+			if err == nil {
+				err = t.check(x)
+			}
+			if err == nil {
+				err = set(v, x)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintf(p.w, "invalid %s: %s\n", name, err)
+	}
+}
+
+func (p *prompter) read(secret bool) (string, error) {
+	if secret && p.secret != nil {
+		return p.secret()
+	}
+	s, err := p.r.ReadString('\n')
+	if err == io.EOF && s != "" {
+		return s, nil
+	}
+	return s, err
+}
@@ -11,4 +11,5 @@ require (
 	golang.org/x/net v0.44.0
 	golang.org/x/sync v0.17.0
 	golang.org/x/sys v0.36.0
+	golang.org/x/term v0.35.0
 )
@@ -0,0 +1,145 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// BackupStepPages is the number of pages Backup copies per step; the db is only locked during a step
+var BackupStepPages = 1024
+
+// BackupStepSleep is the time Backup waits between steps to let writers through
+var BackupStepSleep = 10 * time.Millisecond
+
+// Backup copies the db to the file dst using the online backup API, i.e. a consistent copy is created
+// while the db is in use. progress (if non-nil) is called after each step with the remaining and total pages.
+// The copy is written to dst.tmp and renamed once it's complete.
+func (db *DB) Backup(ctx context.Context, dst string, progress func(remaining, total int)) error {
+	tmp := dst + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	defer os.Remove(tmp)
+	dstDB, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer dstDB.Close()
+	src := db.DB
+	if db.reader != nil {
+		src = db.reader
+	}
+	err = rawConn(ctx, dstDB, func(dc *sqlite3.SQLiteConn) error {
+		return rawConn(ctx, src, func(sc *sqlite3.SQLiteConn) error {
+			b, err := dc.Backup("main", sc, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := b.Step(BackupStepPages)
+				if err != nil {
+					return errors.Join(err, b.Finish())
+				} else if progress != nil {
+					progress(b.Remaining(), b.PageCount())
+				}
+				if done {
+					return b.Finish()
+				}
+				select {
+				case <-ctx.Done():
+					return errors.Join(ctx.Err(), b.Finish())
+				case <-time.After(BackupStepSleep):
+				}
+			}
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to backup: %w", err)
+	} else if err := dstDB.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Snapshot writes a vacuumed copy of the db to the file dst using VACUUM INTO
+func (db *DB) Snapshot(ctx context.Context, dst string) error {
+	tmp := dst + ".tmp"
+	if err := os.Remove(tmp); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, _, err := ExecContext(ctx, db, "VACUUM INTO ?", tmp); err != nil {
+		return fmt.Errorf("failed to snapshot: %w", err)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Restore replaces the db file of uri (see New) with the backup or snapshot src after checking its integrity.
+// The db must not be open; its WAL and shared memory files are removed as they belong to the replaced file.
+func Restore(ctx context.Context, src, uri string) error {
+	name, _, _ := strings.Cut(strings.TrimPrefix(uri, "file:"), "?")
+	srcDB, err := sql.Open("sqlite3", "file:"+src+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+	if v, err := QueryOneContext[string](ctx, srcDB, "PRAGMA integrity_check"); err != nil {
+		return fmt.Errorf("failed to check %s: %w", src, err)
+	} else if v != "ok" {
+		return fmt.Errorf("failed to restore corrupt %s: %s", src, v)
+	}
+	tmp := name + ".restore"
+	defer os.Remove(tmp)
+	if err := copyFile(src, tmp); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(name + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(tmp, name)
+}
+
+func rawConn(ctx context.Context, db *sql.DB, f func(*sqlite3.SQLiteConn) error) error {
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Raw(func(dc any) error {
+		sc, ok := dc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver conn %T", dc)
+		}
+		return f(sc)
+	})
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return errors.Join(err, w.Close())
+	} else if err := w.Sync(); err != nil {
+		return errors.Join(err, w.Close())
+	}
+	return w.Close()
+}
@@ -26,11 +26,14 @@ type Connection interface {
 type DB struct {
 	*sql.DB
 	ConnectHook func(c *sqlite3.SQLiteConn) error
+	uri, driver string
+	reader      *sql.DB
 }
 
 type Table[T any] struct {
 	name, idCol string
 	*DB
+	tx *Tx
 }
 
 func New(uri string, migrations []string, f func(c *sqlite3.SQLiteConn) error, ffw int) (*DB, error) {
@@ -44,7 +47,7 @@ func New(uri string, migrations []string, f func(c *sqlite3.SQLiteConn) error, f
 	if err != nil {
 		return nil, fmt.Errorf("failed to open: %w", err)
 	}
-	d.DB = db
+	d.DB, d.uri, d.driver = db, uri, driver
 	ctx := context.Background()
 	err = d.MigrateContext(ctx, migrations)
 	if ffw == 0 {
@@ -90,7 +93,19 @@ func FuncHook(fs map[string]any) func(c *sqlite3.SQLiteConn) error {
 }
 
 func NewTable[T any](db *DB, name, idCol string) *Table[T] {
-	return &Table[T]{name, normalizedCol(idCol), db}
+	return &Table[T]{name, normalizedCol(idCol), db, nil}
+}
+
+// In returns a copy of t that runs its queries in tx
+func (t *Table[T]) In(tx *Tx) *Table[T] {
+	return &Table[T]{t.name, t.idCol, t.DB, tx}
+}
+
+func (t *Table[T]) conn() Connection {
+	if t.tx != nil {
+		return t.tx
+	}
+	return t.DB
 }
 
 func (t *Table[T]) Count(conds string, args ...any) (int, error) {
@@ -98,7 +113,7 @@ func (t *Table[T]) Count(conds string, args ...any) (int, error) {
 }
 
 func (t *Table[T]) CountContext(ctx context.Context, conds string, args ...any) (int, error) {
-	n, err := QueryOneContext[int](ctx, t.DB, "SELECT count(1) FROM `"+t.name+"` WHERE "+conds, args...)
+	n, err := QueryOneContext[int](ctx, t.conn(), "SELECT count(1) FROM `"+t.name+"` WHERE "+conds, args...)
 	return n, err
 }
 
@@ -111,7 +126,7 @@ func (t *Table[T]) InsertContext(ctx context.Context, or string, v T) (int64, er
 	if rv := reflect.ValueOf(idV); !rv.IsZero() {
 		kvs[idK] = idV
 	}
-	return InsertContext(ctx, t.DB, or, t.name, kvs)
+	return InsertContext(ctx, t.conn(), or, t.name, kvs)
 }
 
 func (t *Table[T]) Modify(id any, f func(*T) error, ks ...string) error {
@@ -119,7 +134,7 @@ func (t *Table[T]) Modify(id any, f func(*T) error, ks ...string) error {
 }
 
 func (t *Table[T]) ModifyContext(ctx context.Context, id any, f func(*T) error, ks ...string) error {
-	v, err := QueryOneContext[T](ctx, t.DB, `SELECT {cols "cols"} FROM {'table} WHERE {'k} = {$v}`, Args{
+	v, err := QueryOneContext[T](ctx, t.conn(), `SELECT {cols "cols"} FROM {'table} WHERE {'k} = {$v}`, Args{
 		"k": t.idCol, "v": id, "table": t.name, "cols": append(ks, t.idCol),
 	})
 	if err != nil {
@@ -151,37 +166,37 @@ func (t *Table[T]) UpdateContext(ctx context.Context, v T, ks ...string) error {
 		}
 	}
 	kvs = nkvs
-	return UpdateContext(ctx, t.DB, t.name, idK, idV, kvs)
+	return UpdateContext(ctx, t.conn(), t.name, idK, idV, kvs)
 }
 
 func (db *DB) Migrate(migrations []string) error {
 	return db.MigrateContext(context.Background(), migrations)
 }
 
+// MigrateContext applies a list of migration statements (compatibility mode). Applied statements are stored
+// in _migrations; any change to them requires a rebuild (see New). Prefer versioned migrations (see NewVersioned).
 func (db *DB) MigrateContext(ctx context.Context, migrations []string) error {
 	if migrations == nil {
 		return nil
 	}
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback()
-	_, _, err = ExecContext(ctx, tx, `CREATE TABLE IF NOT EXISTS _migrations (sql TEXT)`)
-	if err != nil {
-		return fmt.Errorf("failed to create _migrations table: %w", err)
-	}
-	appliedMigrations, err := QueryMapContext[string](ctx, tx, "SELECT sql FROM _migrations")
-	if err != nil {
-		return fmt.Errorf("failed to query _migrations: %w", err)
-	}
-	rebuild := len(migrations) != len(appliedMigrations)
-	if !rebuild {
-		for i := range appliedMigrations {
-			rebuild = rebuild || migrations[i] != appliedMigrations[i]["sql"]
+	return db.TxImmediate(ctx, func(tx *Tx) error {
+		_, _, err := ExecContext(ctx, tx, `CREATE TABLE IF NOT EXISTS _migrations (sql TEXT)`)
+		if err != nil {
+			return fmt.Errorf("failed to create _migrations table: %w", err)
+		}
+		appliedMigrations, err := QueryMapContext[string](ctx, tx, "SELECT sql FROM _migrations")
+		if err != nil {
+			return fmt.Errorf("failed to query _migrations: %w", err)
+		}
+		rebuild := len(migrations) != len(appliedMigrations)
+		if !rebuild {
+			for i := range appliedMigrations {
+				rebuild = rebuild || migrations[i] != appliedMigrations[i]["sql"]
+			}
+		}
+		if rebuild && len(appliedMigrations) != 0 {
+			return &MigrateError{Reason: "rebuild"}
 		}
-	}
-	if !rebuild || len(appliedMigrations) == 0 {
 		for _, stmt := range migrations[len(appliedMigrations):] {
 			if _, _, err := ExecContext(ctx, tx, stmt); err != nil {
 				return fmt.Errorf("failed to apply migration %q: %w", stmt, err)
@@ -190,7 +205,6 @@ func (db *DB) MigrateContext(ctx context.Context, migrations []string) error {
 				return fmt.Errorf("failed to record migration %q: %w", stmt, err)
 			}
 		}
-		return tx.Commit()
-	}
-	return &MigrateError{Reason: "rebuild"}
+		return nil
+	})
 }
@@ -1,9 +1,16 @@
 package sq
 
 import (
+	"context"
+	"encoding/json/v2"
 	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -180,3 +187,612 @@ func newDB[T any](t *testing.T, v T) *DB {
 	t.Cleanup(func() { db.Close() })
 	return db
 }
+
+func TestMigrateTo(t *testing.T) {
+	ctx, uri := context.Background(), t.TempDir()+"/m.db"
+	ms := []Migration{
+		{1, "items", "CREATE TABLE items (id INTEGER PRIMARY KEY)", "DROP TABLE items"},
+		{2, "items_name", "ALTER TABLE items ADD COLUMN name TEXT", "ALTER TABLE items DROP COLUMN name"},
+		{3, "tags", "CREATE TABLE tags (name TEXT)", ""},
+	}
+	if db, err := NewVersioned(uri, ms[:1], nil); err != nil {
+		t.Fatal(err)
+	} else if _, err := db.Rollback(ctx, -1, false); err == nil {
+		t.Fatal("expected error for negative rollback")
+	} else if plan, err := db.Rollback(ctx, 0, false); err != nil || len(plan) != 0 {
+		t.Fatalf("expected empty rollback: %v %v", plan, err)
+	} else if _, err := db.Rollback(ctx, 1, false); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := New(uri, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	versions := func() string {
+		ss, err := db.Status(ctx, ms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs := []string{}
+		for _, s := range ss {
+			vs = append(vs, fmt.Sprintf("%d:%v", s.Version, !s.AppliedAt.IsZero()))
+		}
+		return strings.Join(vs, " ")
+	}
+	if plan, err := db.MigrateTo(ctx, ms, 2, true); err != nil || plan.String() != "-- up 1 items\n"+ms[0].Up+"\n-- up 2 items_name\n"+ms[1].Up+"\n" {
+		t.Fatalf("unexpected dry run: %q %v", plan, err)
+	} else if v := versions(); v != "1:false 2:false 3:false" {
+		t.Fatalf("dry run applied migrations: %s", v)
+	}
+	if _, err := db.MigrateTo(ctx, ms, Latest, false); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := Exec(db, "INSERT INTO items (name) VALUES ('x')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Rollback(ctx, 1, false); err == nil || !strings.Contains(err.Error(), "has no down step") {
+		t.Fatalf("expected irreversible error: %v", err)
+	} else if _, _, err := Exec(db, "UPDATE _sq_migrations SET down = 'DROP TABLE tags' WHERE version = 3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MigrateTo(ctx, ms[:2], 1, false); err != nil {
+		t.Fatal(err)
+	} else if v := versions(); v != "1:true 2:false 3:false" {
+		t.Fatalf("unexpected status: %s", v)
+	} else if _, err := QueryOne[int](db, "SELECT count(name) FROM items"); err == nil {
+		t.Fatalf("expected column name to be dropped")
+	}
+	if _, err := db.MigrateTo(ctx, ms[:2], 2, false); err != nil {
+		t.Fatal(err)
+	}
+	ms[1].Up += " -- edited"
+	if _, err := db.MigrateTo(ctx, ms[:2], 1, false); err != nil {
+		t.Fatalf("expected rollback of modified migration: %v", err)
+	}
+	ms[0].Up += " STRICT"
+	if _, err := db.MigrateTo(ctx, ms, Latest, false); err == nil || !strings.Contains(err.Error(), "modified after it was applied") {
+		t.Fatalf("expected checksum error: %v", err)
+	} else if _, err := db.Rollback(ctx, 5, false); err != nil {
+		t.Fatal(err)
+	} else if v := versions(); v != "1:false 2:false 3:false" {
+		t.Fatalf("unexpected status: %s", v)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	type Item struct {
+		ID    int
+		Name  string
+		Price int
+	}
+	db, err := New(t.TempDir()+"/diff.db", []string{Schema(Item{}), "CREATE INDEX items_name ON Items (Name)"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, _, err := Exec(db, "INSERT INTO Items (Name, Price) VALUES ('a', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	migrate := func(want []string, vs ...any) {
+		t.Helper()
+		stmts, err := Diff(db, vs...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, stmt := range stmts {
+			if i >= len(want) || !strings.HasPrefix(stmt, want[i]) {
+				t.Fatalf("got statements %q, want %q", stmts, want)
+			} else if _, _, err := Exec(db, stmt); err != nil {
+				t.Fatalf("%s: %v", stmt, err)
+			}
+		}
+		if len(stmts) != len(want) {
+			t.Fatalf("got statements %q, want %q", stmts, want)
+		} else if stmts, err := Diff(db, vs...); err != nil || len(stmts) != 0 {
+			t.Fatalf("expected no changes after migration: %q %v", stmts, err)
+		}
+	}
+	if err := TrackChanges(context.Background(), db, "Items"); err != nil {
+		t.Fatal(err)
+	}
+	dropTriggers := []string{
+		"DROP TRIGGER IF EXISTS `_sq_changes_Items_insert`",
+		"DROP TRIGGER IF EXISTS `_sq_changes_Items_update`",
+		"DROP TRIGGER IF EXISTS `_sq_changes_Items_delete`",
+	}
+	createTriggers := []string{
+		"CREATE TRIGGER `_sq_changes_Items_insert`",
+		"CREATE TRIGGER `_sq_changes_Items_update`",
+		"CREATE TRIGGER `_sq_changes_Items_delete`",
+	}
+	{
+		type Item struct {
+			ID    int
+			Title string `was:"Name"`
+			Price int
+			Desc  string
+		}
+		migrate(slices.Concat(dropTriggers, []string{
+			"ALTER TABLE `Items` RENAME COLUMN `Name` TO `Title`",
+			"DROP INDEX IF EXISTS `items_name`",
+			"ALTER TABLE `Items` ADD COLUMN `Desc`",
+			"CREATE INDEX items_title",
+		}, createTriggers), Item{}, "CREATE INDEX items_title ON Items (Title)")
+	}
+	{
+		type Item struct {
+			ID    int
+			Title string `was:"Name"`
+			Price int    `sq:"NOT NULL DEFAULT 0"`
+		}
+		migrate(slices.Concat(dropTriggers, []string{
+			"CREATE TABLE `_sq_new_Items`",
+			"INSERT INTO `_sq_new_Items` (`ID`, `Title`, `Price`) SELECT `ID`, `Title`, `Price` FROM `Items`",
+			"DROP TABLE `Items`",
+			"ALTER TABLE `_sq_new_Items` RENAME TO `Items`",
+			"CREATE INDEX items_title",
+		}, createTriggers), Item{}, "CREATE INDEX items_title ON Items (Title)")
+	}
+	if v, err := QueryOneMap[any](db, "SELECT * FROM Items"); err != nil || fmt.Sprint(v) != "map[ID:1 Price:1 Title:a]" {
+		t.Fatalf("expected data to be preserved: %v %v", v, err)
+	} else if _, _, err := Exec(db, "UPDATE Items SET Price = 2"); err != nil {
+		t.Fatal(err)
+	} else if v, err := QueryOne[string](db, "SELECT new FROM _sq_changes ORDER BY id DESC LIMIT 1"); err != nil ||
+		v != `{"ID":1,"Title":"a","Price":2}` {
+		t.Fatalf("expected changes to be tracked for the new columns: %v %v", v, err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	WatchInterval = 10 * time.Millisecond
+	db, err := New(t.TempDir()+"/watch.db", []string{"CREATE TABLE items (name TEXT, tags JSON_TEXT)"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	watch := func(cursor int64, n int, timeout time.Duration) []Change {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cs := []Change{}
+		for c := range WatchFrom(ctx, db, cursor, "items") {
+			if c.Err != nil {
+				t.Fatal(c.Err)
+			} else if cs = append(cs, c); len(cs) == n {
+				break
+			}
+		}
+		return cs
+	}
+	if cs := watch(-1, 0, 100*time.Millisecond); len(cs) != 0 {
+		t.Fatalf("expected no changes: %v", cs)
+	}
+	for _, q := range []string{
+		`INSERT INTO items VALUES ('a', '["x"]')`,
+		`UPDATE items SET name = 'b'`,
+		`DELETE FROM items`,
+	} {
+		if _, _, err := Exec(db, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cs := watch(0, 3, 5*time.Second)
+	got := []string{}
+	for _, c := range cs {
+		got = append(got, fmt.Sprintf("%s %s %d %v %v", c.Table, c.Op, c.RowID, c.Old, c.New))
+	}
+	if want := []string{
+		"items INSERT 1 map[] map[name:a tags:[x]]",
+		"items UPDATE 1 map[name:a tags:[x]] map[name:b tags:[x]]",
+		"items DELETE 1 map[name:b tags:[x]] map[]",
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got changes %q, want %q", got, want)
+	} else if cs := watch(cs[1].ID, 1, 5*time.Second); cs[0].Op != "DELETE" {
+		t.Fatalf("expected to resume after cursor: %v", cs)
+	}
+
+	cols, vals := []string{}, []string{}
+	for i := range 200 {
+		cols, vals = append(cols, fmt.Sprintf("c%d TEXT", i)), append(vals, fmt.Sprintf("'%d'", i))
+	}
+	vals[150] = "NULL"
+	if _, _, err := Exec(db, "CREATE TABLE wide ("+strings.Join(cols, ", ")+")"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := TrackChanges(ctx, db, "wide"); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := Exec(db, "INSERT INTO wide VALUES ("+strings.Join(vals, ", ")+")"); err != nil {
+		t.Fatal(err)
+	}
+	for c := range WatchFrom(ctx, db, 0, "wide") {
+		if c.Err != nil {
+			t.Fatal(c.Err)
+		} else if v, ok := c.New["c150"]; len(c.New) != 200 || c.New["c199"] != "199" || !ok || v != nil {
+			t.Fatalf("expected all cols of wide row: %v", c.New)
+		}
+		return
+	}
+	t.Fatalf("expected change of wide row")
+}
+
+func TestBackup(t *testing.T) {
+	ctx, dir := context.Background(), t.TempDir()
+	uri := dir + "/db.sqlite?_journal_mode=WAL"
+	db, err := New(uri, []string{"CREATE TABLE items (name TEXT)"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, _, err := Exec(db, "INSERT INTO items VALUES ('a')"); err != nil {
+		t.Fatal(err)
+	}
+	BackupStepPages, BackupStepSleep = 1, 0
+	steps := 0
+	if err := db.Backup(ctx, dir+"/backup.sqlite", func(remaining, total int) { steps++ }); err != nil {
+		t.Fatal(err)
+	} else if steps < 2 {
+		t.Fatalf("expected incremental backup steps: %d", steps)
+	} else if err := db.Snapshot(ctx, dir+"/snapshot.sqlite"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := Exec(db, "INSERT INTO items VALUES ('b')"); err != nil {
+		t.Fatal(err)
+	} else if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range []string{"backup.sqlite", "snapshot.sqlite"} {
+		if err := Restore(ctx, dir+"/"+src, uri); err != nil {
+			t.Fatal(err)
+		}
+		db, err := New(uri, []string{"CREATE TABLE items (name TEXT)"}, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vs, err := Query[string](db, "SELECT name FROM items"); err != nil || fmt.Sprint(vs) != "[a]" {
+			t.Fatalf("%s: expected restored items: %v %v", src, vs, err)
+		}
+		db.Close()
+	}
+	if err := os.WriteFile(dir+"/corrupt.sqlite", []byte("not a db"), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := Restore(ctx, dir+"/corrupt.sqlite", uri); err == nil {
+		t.Fatalf("expected error restoring corrupt file")
+	}
+}
+
+func TestFind(t *testing.T) {
+	type Item struct {
+		ID    int
+		Name  string
+		Price int
+		Tags  []string
+		Meta  map[string]any
+	}
+	ctx, db := context.Background(), newDB(t, Item{})
+	items := NewTable[Item](db, "Items", "ID")
+	for i, name := range []string{"apple", "banana", "cherry", "avocado"} {
+		meta := map[string]any{"color": []string{"red", "yellow", "red", "green"}[i]}
+		if _, err := items.Insert("", Item{Name: name, Price: i + 1, Tags: []string{name[:1]}, Meta: meta}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := func(s *Selection[Item]) string {
+		t.Helper()
+		vs, err := s.All(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ns := []string{}
+		for _, v := range vs {
+			ns = append(ns, v.Name)
+		}
+		return strings.Join(ns, " ")
+	}
+	for _, c := range []struct {
+		s    *Selection[Item]
+		want string
+	}{
+		{items.Find(), "apple banana cherry avocado"},
+		{items.Find(Like("Name", "a%")).OrderBy("-Name"), "avocado apple"},
+		{items.Find(Or(Eq("Name", "banana"), Between("Price", 3, 4))).OrderBy("Price"), "banana cherry avocado"},
+		{items.Find(In("Price", 1, 4), Not(Eq("Name", "apple"))), "avocado"},
+		{items.Find(Eq("Meta->$.color", "red")).OrderBy("Name"), "apple cherry"},
+		{items.Find(Has("Tags", "b")), "banana"},
+		{items.Find().OrderBy("Meta->$.color", "-ID").Limit(2).Offset(1), "cherry apple"},
+		{items.Find().OrderBy("Meta->$.color", "-ID").After("red", 3).Limit(2), "apple banana"},
+		{items.Find(Filter{}, Or(Filter{}, Eq("Name", "cherry"))), "cherry"},
+	} {
+		if got := names(c.s); got != c.want {
+			t.Fatalf("got %q, want %q", got, c.want)
+		}
+	}
+	if _, err := items.Find(Eq("Name; DROP TABLE Items", 1)).All(ctx); err == nil {
+		t.Fatalf("expected invalid identifier error")
+	} else if _, err := items.Find().OrderBy("Meta->$.size", "ID").After(nil, 1).All(ctx); err == nil {
+		t.Fatalf("expected nil after value error")
+	} else if n, err := items.Find(Eq("Meta->$.size", nil)).OrderBy("ID").Offset(3).Count(ctx); err != nil || n != 4 {
+		t.Fatalf("count: %v %v", n, err)
+	}
+	type Tag struct{ Name string }
+	if _, _, err := Exec(db, "CREATE TABLE Tags (Name TEXT UNIQUE)"); err != nil {
+		t.Fatal(err)
+	}
+	tags := NewTable[Tag](db, "Tags", "")
+	if id, err := tags.Upsert(Tag{"x"}, "Name"); err != nil || id != 1 {
+		t.Fatalf("upsert: %v %v", id, err)
+	} else if id, err := tags.Upsert(Tag{"x"}, "Name"); err != nil || id != 1 {
+		t.Fatalf("upsert existing: %v %v", id, err)
+	}
+	if id, err := items.Upsert(Item{ID: 2, Name: "blueberry", Price: 5}); err != nil || id != 2 {
+		t.Fatalf("upsert: %v %v", id, err)
+	} else if id, err := items.Upsert(Item{Name: "date"}); err != nil || id != 5 {
+		t.Fatalf("upsert: %v %v", id, err)
+	} else if n, err := items.Find(Like("Name", "%e%")).Delete(ctx); err != nil || n != 4 {
+		t.Fatalf("delete: %v %v", n, err)
+	} else if got := names(items.Find()); got != "avocado" {
+		t.Fatalf("got %q after upsert and delete", got)
+	}
+}
+
+func TestTx(t *testing.T) {
+	type Item struct {
+		ID   int
+		Name string
+	}
+	ctx, db := context.Background(), newDB(t, Item{})
+	items := NewTable[Item](db, "Items", "ID")
+	errAbort := fmt.Errorf("abort")
+	names := func() string {
+		vs, err := Query[string](db, "SELECT Name FROM Items ORDER BY ID")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(vs, " ")
+	}
+	if err := db.Tx(ctx, func(tx *Tx) error {
+		if _, err := items.In(tx).Insert("", Item{Name: "a"}); err != nil {
+			return err
+		} else if err := tx.Tx(ctx, func(tx *Tx) error {
+			items.In(tx).Insert("", Item{Name: "b"})
+			return errAbort
+		}); err != errAbort {
+			return fmt.Errorf("expected savepoint error: %w", err)
+		}
+		return tx.Tx(ctx, func(tx *Tx) error {
+			_, err := items.In(tx).Insert("", Item{Name: "c"})
+			return err
+		})
+	}); err != nil {
+		t.Fatal(err)
+	} else if got := names(); got != "a c" {
+		t.Fatalf("expected savepoint to be rolled back: %q", got)
+	}
+	if err := db.Tx(ctx, func(tx *Tx) error {
+		items.In(tx).Insert("", Item{Name: "d"})
+		return errAbort
+	}); err != errAbort {
+		t.Fatalf("expected abort error: %v", err)
+	}
+	func() {
+		defer func() { recover() }()
+		db.Tx(ctx, func(tx *Tx) error {
+			items.In(tx).Insert("", Item{Name: "e"})
+			panic("boom")
+		})
+	}()
+	if got := names(); got != "a c" {
+		t.Fatalf("expected error and panic to roll back: %q", got)
+	}
+
+	uri := t.TempDir() + "/busy.db?_busy_timeout=0&_journal_mode=WAL"
+	db1, err := New(uri, []string{"CREATE TABLE xs (x INTEGER)"}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.Close()
+	db2, err := New(uri, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	locked, done, attempts := make(chan struct{}), make(chan error), 0
+	go func() {
+		done <- db1.TxImmediate(ctx, func(tx *Tx) error {
+			close(locked)
+			time.Sleep(50 * time.Millisecond)
+			return nil
+		})
+	}()
+	<-locked
+	if err := db2.TxImmediate(ctx, func(tx *Tx) error {
+		attempts++
+		_, _, err := Exec(tx, "INSERT INTO xs VALUES (1)")
+		return err
+	}); err != nil || attempts != 1 {
+		t.Fatalf("expected busy transaction to be retried: %v %d", err, attempts)
+	} else if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	db1.SetMaxOpenConns(1)
+	c, err := db1.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := c.ExecContext(ctx, "BEGIN"); err != nil {
+		t.Fatal(err)
+	} else if err := release(c); err != nil {
+		t.Fatal(err)
+	} else if err := db1.Tx(ctx, func(tx *Tx) error { return nil }); err != nil {
+		t.Fatalf("expected connection left in a transaction to be discarded: %v", err)
+	}
+}
+
+func TestSplitReads(t *testing.T) {
+	type Item struct {
+		ID   int
+		Name string
+	}
+	ctx, dir := context.Background(), t.TempDir()
+	db, err := New(dir+"/split.db?_busy_timeout=0", []string{Schema(Item{})}, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.SplitReads(4); err != nil {
+		t.Fatal(err)
+	}
+	items := NewTable[Item](db, "Items", "ID")
+	if _, err := items.Insert("", Item{Name: "a"}); err != nil {
+		t.Fatal(err)
+	} else if id, err := items.Upsert(Item{ID: 1, Name: "b"}); err != nil || id != 1 {
+		t.Fatalf("expected RETURNING query to go to the writer: %v %d", err, id)
+	} else if _, err := db.reader.ExecContext(ctx, "INSERT INTO Items (Name) VALUES ('c')"); err == nil {
+		t.Fatal("expected readers to be read-only")
+	}
+	locked, done := make(chan struct{}), make(chan struct{})
+	go db.TxImmediate(ctx, func(tx *Tx) error {
+		defer close(done)
+		Exec(tx, "INSERT INTO Items (Name) VALUES ('c')")
+		close(locked)
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	<-locked
+	if n, err := QueryOne[int](db, "SELECT count(1) FROM Items"); err != nil || n != 1 {
+		t.Fatalf("expected read during write transaction: %v %d", err, n)
+	} else if _, _, err := Exec(db, "INSERT INTO Items (Name) VALUES ('d')"); err != nil {
+		t.Fatalf("expected writer to wait for the transaction: %v", err)
+	}
+	<-done
+	if n, err := items.Count("1"); err != nil || n != 3 {
+		t.Fatalf("expected 3 items: %v %d", err, n)
+	}
+	for q, want := range map[string]bool{
+		"SELECT 1": true,
+		"WITH xs(x) AS (SELECT 1) SELECT x FROM xs":                              true,
+		"WITH xs AS (SELECT 'INSERT') INSERT INTO Items (Name) SELECT * FROM xs": false,
+		"INSERT INTO Items (Name) VALUES ('x') RETURNING ID":                     false,
+	} {
+		if isSelect(q) != want {
+			t.Fatalf("isSelect(%q) != %v", q, want)
+		}
+	}
+	defer func(pages int, sleep time.Duration) { BackupStepPages, BackupStepSleep = pages, sleep }(BackupStepPages, BackupStepSleep)
+	BackupStepPages, BackupStepSleep = 1, 0
+	stepped, written, backedUp, once := make(chan struct{}), make(chan struct{}), make(chan error, 1), sync.Once{}
+	go func() {
+		backedUp <- db.Backup(ctx, dir+"/backup.db", func(int, int) {
+			once.Do(func() { close(stepped); <-written })
+		})
+	}()
+	<-stepped
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, _, err := ExecContext(wctx, db, "INSERT INTO Items (Name) VALUES ('e')"); err != nil {
+		t.Fatalf("expected write to not wait for the backup: %v", err)
+	}
+	close(written)
+	if err := <-backedUp; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	migrations := []string{`CREATE TABLE apps (id INTEGER PRIMARY KEY, name TEXT NOT NULL, owner_id INTEGER,
+                                               config JSON_TEXT, created_at TIMESTAMP)`}
+	write := func(name, src string) string {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(dir, name)
+	}
+	queries := write("apps.sql", `
+-- name: ListApps :many
+-- ListApps returns the apps of an owner
+SELECT id, name, config, created_at FROM apps WHERE owner_id = :owner_id ORDER BY name;
+
+-- name: GetAppName :one
+SELECT name FROM apps WHERE id = ?;
+
+-- name: CountApps :one int
+SELECT count(1) FROM apps WHERE re_extract(name, '(:x)', 1) != '';
+
+-- name: DeleteApp :exec
+DELETE FROM apps WHERE id = @id;
+`)
+	src, err := Generate("db", migrations, FuncHook(nil), queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"// Code generated by sq.Generate. DO NOT EDIT.\n\npackage db\n",
+		"type ListAppsRow struct {\n\tID        int64\n\tName      string\n\tConfig    jsontext.Value\n\tCreatedAt time.Time\n}",
+		"// ListApps returns the apps of an owner\nfunc ListApps(ctx context.Context, c sq.Connection, ownerID int64) ([]ListAppsRow, error) {",
+		`return sq.QueryContext[ListAppsRow](ctx, c, listAppsSQL, sql.Named("owner_id", ownerID))`,
+		"func GetAppName(ctx context.Context, c sq.Connection, args ...any) (string, error) {",
+		"return sq.QueryOneContext[int](ctx, c, countAppsSQL)",
+		"func DeleteApp(ctx context.Context, c sq.Connection, id int64) (int64, int64, error) {",
+	} {
+		if !strings.Contains(string(src), s) {
+			t.Errorf("expected generated code to contain %q:\n%s", s, src)
+		}
+	}
+	if testing.Short() {
+		t.Skip("skipping build of generated code in short mode")
+	}
+	usage := `package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/niklasfasching/x/sq"
+)
+
+func TestQueries(t *testing.T) {
+	ctx := context.Background()
+	db, err := sq.New(t.TempDir()+"/db.sqlite", []string{` + "`" + migrations[0] + "`" + `}, sq.FuncHook(nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, _, err := sq.Exec(db, ` + "`" + `INSERT INTO apps (name, owner_id, config) VALUES ('a', 1, '{"x":1}')` + "`" + `); err != nil {
+		t.Fatal(err)
+	} else if apps, err := ListApps(ctx, db, 1); err != nil || len(apps) != 1 || string(apps[0].Config) != ` + "`" + `{"x":1}` + "`" + ` {
+		t.Fatalf("ListApps: %v %v", apps, err)
+	} else if name, err := GetAppName(ctx, db, apps[0].ID); err != nil || name != "a" {
+		t.Fatalf("GetAppName: %v %v", name, err)
+	} else if _, n, err := DeleteApp(ctx, db, apps[0].ID); err != nil || n != 1 {
+		t.Fatalf("DeleteApp: %v %v", n, err)
+	} else if n, err := CountApps(ctx, db); err != nil || n != 0 {
+		t.Fatalf("CountApps: %v %v", n, err)
+	}
+}
+`
+	// the package only exists in an overlay (see go help build) so nothing is written to the source tree;
+	// the test binary is run outside of it as its package dir does not exist
+	pkg, err := filepath.Abs("testdata/generate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlay, err := json.Marshal(map[string]any{"Replace": map[string]string{
+		filepath.Join(pkg, "queries.go"):      write("queries.go", string(src)),
+		filepath.Join(pkg, "queries_test.go"): write("queries_test.go", usage),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if out, err := exec.Command("go", "test", "-c", "-vet=off", "-o", filepath.Join(dir, "db.test"),
+		"-overlay", write("overlay.json", string(overlay)), pkg).CombinedOutput(); err != nil {
+		t.Fatalf("generated code does not build: %v\n%s\n%s", err, out, src)
+	} else if out, err := exec.Command(filepath.Join(dir, "db.test")).CombinedOutput(); err != nil {
+		t.Fatalf("generated code does not work: %v\n%s\n%s", err, out, src)
+	}
+	drift := write("drift.sql", "-- name: ListApps :many\nSELECT id, title FROM apps")
+	if _, err := Generate("db", migrations, nil, drift); err == nil || !strings.Contains(err.Error(), "drift.sql:1: ListApps: no such column: title") {
+		t.Fatalf("expected schema drift error: %v", err)
+	}
+}
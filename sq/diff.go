@@ -0,0 +1,353 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type schemaObject struct{ Type, Name, TblName, SQL string }
+
+type tableDef struct {
+	cols                []columnDef
+	constraints, suffix string
+}
+
+type columnDef struct{ name, def string }
+
+var whitespaceRe = regexp.MustCompile(`\s+`)
+var nonConstantDefaultRe = regexp.MustCompile(`(?i)\bDEFAULT\s*(\(|CURRENT_)`)
+var generatedRe = regexp.MustCompile(`(?i)\bAS\s*\(`)
+
+func Diff(c Connection, vs ...any) ([]string, error) {
+	return DiffContext(context.Background(), c, vs...)
+}
+
+// DiffContext returns the statements that migrate the live schema of c to the schema of vs: structs
+// (see Schema) and raw SQL strings (e.g. FTSIndex, CREATE INDEX). Columns are added, dropped and renamed
+// (field tag `was:"OldName"`) via ALTER TABLE where SQLite supports it; other changes rebuild the table
+// (requires foreign_keys=off). Indexes, triggers and virtual tables are dropped and recreated if they changed;
+// the triggers of TrackChanges are recreated for the new columns of changed tables.
+// Tables not part of vs are left untouched.
+func DiffContext(ctx context.Context, c Connection, vs ...any) ([]string, error) {
+	stmts, renames := []string{}, map[string]map[string]string{}
+	for _, v := range vs {
+		if s, ok := v.(string); ok {
+			stmts = append(stmts, s)
+			continue
+		}
+		t := reflect.TypeOf(v)
+		if t.Kind() != reflect.Struct {
+			return nil, fmt.Errorf("diff: %T is neither a struct nor SQL", v)
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if was, table := t.Field(i).Tag.Get("was"), strings.ToLower(tableName(t)); was != "" {
+				if renames[table] == nil {
+					renames[table] = map[string]string{}
+				}
+				renames[table][t.Field(i).Name] = was
+			}
+		}
+		stmts = append(stmts, Schema(v))
+	}
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	for _, stmt := range stmts {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return nil, fmt.Errorf("diff: failed to create schema: %w", err)
+		}
+	}
+	want, err := schemaObjects(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	have, err := schemaObjects(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	d := &differ{have: have, want: want, renames: renames}
+	for _, o := range want {
+		if o.Type == "table" {
+			if err := d.table(o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, o := range want {
+		if o.Type != "table" {
+			d.object(o)
+		}
+	}
+	drops, creates, err := d.trackChanges(ctx, c, db)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(drops, d.alters, d.creates, creates), nil
+}
+
+type differ struct {
+	have, want      []schemaObject
+	renames         map[string]map[string]string
+	rebuilt         []string // lower case names of tables that are recreated with all their indexes and triggers
+	changed         []string // lower case names of tables whose columns change
+	alters, creates []string
+}
+
+// table diffs the table o; its statements run before indexes and triggers are (re)created
+func (d *differ) table(o schemaObject) error {
+	h, ok := find(d.have, o.Type, o.Name)
+	if !ok {
+		d.rebuilt, d.alters = append(d.rebuilt, strings.ToLower(o.Name)), append(d.alters, o.SQL)
+		d.alters = append(d.alters, ftsRebuild(o)...)
+		return nil
+	} else if isVirtual(o.SQL) || isVirtual(h.SQL) {
+		if !sameSQL(o.SQL, h.SQL) {
+			d.rebuilt = append(d.rebuilt, strings.ToLower(o.Name))
+			d.alters = append(d.alters, "DROP TABLE "+quoteIdent(h.Name), o.SQL)
+			d.alters = append(d.alters, ftsRebuild(o)...)
+		}
+		return nil
+	}
+	want, err := parseTableDef(o.SQL)
+	if err != nil {
+		return err
+	}
+	have, err := parseTableDef(h.SQL)
+	if err != nil {
+		return err
+	}
+	table, stmts := quoteIdent(h.Name), []string{}
+	renames := d.renames[strings.ToLower(o.Name)]
+	for _, to := range slices.Sorted(maps.Keys(renames)) {
+		if i, j := have.index(renames[to]), have.index(to); i != -1 && j == -1 && want.index(to) != -1 {
+			stmts = append(stmts, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", table, quoteIdent(have.cols[i].name), quoteIdent(to)))
+			have.cols[i].name = to
+		}
+	}
+	rebuild := !sameSQL(want.constraints, have.constraints) || !sameSQL(want.suffix, have.suffix)
+	adds, drops := []string{}, []string{}
+	for _, c := range want.cols {
+		if i := have.index(c.name); i == -1 && isAddable(c.def) {
+			adds = append(adds, strings.TrimSpace(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, quoteIdent(c.name), c.def)))
+		} else if i == -1 || !sameSQL(have.cols[i].def, c.def) {
+			rebuild = true
+		}
+	}
+	for _, c := range have.cols {
+		if i := want.index(c.name); i == -1 && isDroppable(c.def) {
+			drops = append(drops, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, quoteIdent(c.name)))
+		} else if i == -1 {
+			rebuild = true
+		}
+	}
+	if len(stmts) != 0 || len(adds) != 0 || len(drops) != 0 || rebuild {
+		d.changed = append(d.changed, strings.ToLower(o.Name))
+	}
+	if !rebuild {
+		d.alters = append(append(d.alters, stmts...), d.dropObjects(o.Name)...)
+		d.alters = append(append(d.alters, drops...), adds...)
+		return nil
+	}
+	cols, tmp := []string{}, quoteIdent("_sq_new_"+h.Name)
+	for _, c := range want.cols {
+		if i := have.index(c.name); i != -1 && !generatedRe.MatchString(c.def) && !generatedRe.MatchString(have.cols[i].def) {
+			cols = append(cols, quoteIdent(c.name))
+		}
+	}
+	d.rebuilt = append(d.rebuilt, strings.ToLower(o.Name))
+	d.alters = append(d.alters, stmts...)
+	d.alters = append(d.alters,
+		strings.TrimSpace(fmt.Sprintf("CREATE TABLE %s (%s) %s", tmp, want.body(), want.suffix)),
+		fmt.Sprintf("INSERT INTO %s (%[2]s) SELECT %[2]s FROM %s", tmp, strings.Join(cols, ", "), table),
+		"DROP TABLE "+table,
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", tmp, quoteIdent(o.Name)))
+	return nil
+}
+
+// trackChanges returns the statements to recreate the triggers of TrackChanges of the changed tables
+// for their new columns. They are dropped before the tables are altered (DROP COLUMN fails for columns
+// used in triggers and a rebuild drops them) as schemaObjects ignores _sq_ objects.
+func (d *differ) trackChanges(ctx context.Context, c, want Connection) ([]string, []string, error) {
+	ts, err := QueryContext[struct{ Name, TblName string }](ctx, c, `
+      SELECT name, tbl_name FROM sqlite_master
+      WHERE type = 'trigger' AND substr(name, 1, 12) = '_sq_changes_' ORDER BY rowid`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list change triggers: %w", err)
+	}
+	drops, creates := []string{}, []string{}
+	for _, t := range ts {
+		if !slices.Contains(d.changed, strings.ToLower(t.TblName)) {
+			continue
+		}
+		cols, err := QueryMapContext[string](ctx, want, "SELECT name, type FROM pragma_table_info(?)", t.TblName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list columns of %q: %w", t.TblName, err)
+		}
+		name, err := Args{}.ident(t.Name)
+		if err != nil {
+			return nil, nil, err
+		}
+		i := strings.LastIndex(t.Name, "_")
+		stmt, err := changesTrigger(name, t.Name[len("_sq_changes_"):i], strings.ToUpper(t.Name[i+1:]), cols)
+		if err != nil {
+			return nil, nil, err
+		}
+		drops, creates = append(drops, "DROP TRIGGER IF EXISTS "+name), append(creates, stmt)
+	}
+	return drops, creates, nil
+}
+
+// dropObjects drops the indexes and triggers of table that are changed or no longer wanted
+func (d *differ) dropObjects(table string) []string {
+	stmts := []string{}
+	for _, h := range d.have {
+		if !strings.EqualFold(h.TblName, table) || h.Type == "table" {
+			continue
+		} else if w, ok := find(d.want, h.Type, h.Name); !ok || !sameSQL(w.SQL, h.SQL) {
+			stmts = append(stmts, fmt.Sprintf("DROP %s IF EXISTS %s", strings.ToUpper(h.Type), quoteIdent(h.Name)))
+		}
+	}
+	return stmts
+}
+
+// object creates the index or trigger o if it's missing, changed or its table was recreated
+func (d *differ) object(o schemaObject) {
+	if _, ok := find(d.have, "table", o.TblName); ok && !slices.Contains(d.rebuilt, strings.ToLower(o.TblName)) {
+		if h, ok := find(d.have, o.Type, o.Name); ok && sameSQL(h.SQL, o.SQL) {
+			return
+		}
+	}
+	d.creates = append(d.creates, o.SQL)
+}
+
+func schemaObjects(ctx context.Context, c Connection) ([]schemaObject, error) {
+	os, err := QueryContext[schemaObject](ctx, c, `
+      SELECT type, name, tbl_name, sql FROM sqlite_master
+      WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' AND name != '_migrations' AND substr(name, 1, 4) != '_sq_'
+        AND name NOT IN (SELECT name FROM pragma_table_list WHERE type = 'shadow')
+      ORDER BY rowid`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schema: %w", err)
+	}
+	return os, nil
+}
+
+func find(os []schemaObject, typ, name string) (schemaObject, bool) {
+	for _, o := range os {
+		if o.Type == typ && strings.EqualFold(o.Name, name) {
+			return o, true
+		}
+	}
+	return schemaObject{}, false
+}
+
+// parseTableDef splits the CREATE TABLE statement s into its column definitions (without names),
+// table constraints and table options
+func parseTableDef(s string) (tableDef, error) {
+	start, end := strings.Index(s, "("), strings.LastIndex(s, ")")
+	if start == -1 || end < start {
+		return tableDef{}, fmt.Errorf("failed to parse table definition: %q", s)
+	}
+	t, constraints := tableDef{suffix: normalizeSQL(s[end+1:])}, []string{}
+	for _, x := range splitTopLevel(s[start+1 : end]) {
+		name, def, _ := strings.Cut(normalizeSQL(x), " ")
+		switch strings.ToUpper(name) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			constraints = append(constraints, normalizeSQL(x))
+		default:
+			t.cols = append(t.cols, columnDef{strings.Trim(name, "`\"[]"), def})
+		}
+	}
+	t.constraints = strings.Join(constraints, ", ")
+	return t, nil
+}
+
+// splitTopLevel splits s at commas outside of parentheses and quotes
+func splitTopLevel(s string) []string {
+	parts, depth, quote, last := []string{}, 0, rune(0), 0
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '[':
+			quote = ']'
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ',' && depth == 0:
+			parts, last = append(parts, s[last:i]), i+1
+		}
+	}
+	return append(parts, s[last:])
+}
+
+func (t tableDef) index(name string) int {
+	return slices.IndexFunc(t.cols, func(c columnDef) bool { return strings.EqualFold(c.name, name) })
+}
+
+func (t tableDef) body() string {
+	xs := []string{}
+	for _, c := range t.cols {
+		xs = append(xs, strings.TrimSpace(quoteIdent(c.name)+" "+c.def))
+	}
+	if t.constraints != "" {
+		xs = append(xs, t.constraints)
+	}
+	return strings.Join(xs, ", ")
+}
+
+// isAddable returns whether a column can be added via ALTER TABLE ADD COLUMN (see https://sqlite.org/lang_altertable.html)
+func isAddable(def string) bool {
+	s := strings.ToUpper(def)
+	return !strings.Contains(s, "PRIMARY KEY") && !strings.Contains(s, "UNIQUE") &&
+		!nonConstantDefaultRe.MatchString(def) && !(generatedRe.MatchString(def) && strings.Contains(s, "STORED")) &&
+		!(strings.Contains(s, "NOT NULL") && (!strings.Contains(s, "DEFAULT") || strings.Contains(s, "DEFAULT NULL")))
+}
+
+// isDroppable returns whether a column can be dropped via ALTER TABLE DROP COLUMN
+func isDroppable(def string) bool {
+	s := strings.ToUpper(def)
+	return !strings.Contains(s, "PRIMARY KEY") && !strings.Contains(s, "UNIQUE") && !strings.Contains(s, "REFERENCES")
+}
+
+// ftsRebuild returns the statement to populate the fts5 external content table o (see FTSIndex)
+func ftsRebuild(o schemaObject) []string {
+	if s := strings.ToLower(o.SQL); !isVirtual(o.SQL) || !strings.Contains(s, "fts5(") || !strings.Contains(s, "content=") || strings.Contains(s, "content=''") {
+		return nil
+	}
+	return []string{fmt.Sprintf("INSERT INTO %[1]s(%[1]s) VALUES ('rebuild')", quoteIdent(o.Name))}
+}
+
+func isVirtual(sql string) bool {
+	return strings.HasPrefix(strings.ToUpper(normalizeSQL(sql)), "CREATE VIRTUAL TABLE")
+}
+
+func normalizeSQL(s string) string {
+	return strings.TrimSpace(whitespaceRe.ReplaceAllString(s, " "))
+}
+
+// sameSQL compares the statements a and b ignoring whitespace and identifier quotes (which e.g. RENAME COLUMN adds)
+func sameSQL(a, b string) bool {
+	r := strings.NewReplacer("`", "", `"`, "")
+	return r.Replace(normalizeSQL(a)) == r.Replace(normalizeSQL(b))
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,281 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Filter is a condition of a Selection. Columns are field names or "Col->$.json.path" for values inside
+// JSON_TEXT columns; they are validated and all values are bound as args.
+type Filter struct {
+	sql  string
+	args []any
+	err  error
+}
+
+// Selection is the result of Table.Find: the rows of a table matching filters in order.
+type Selection[T any] struct {
+	t             *Table[T]
+	where         Filter
+	order         []string
+	after         []any
+	limit, offset int
+}
+
+// Eq matches rows where col equals v; a nil v matches NULL
+func Eq(col string, v any) Filter {
+	if rv := reflect.ValueOf(v); v == nil || rv.Kind() == reflect.Pointer && rv.IsNil() {
+		c, args, err := column(col)
+		return Filter{c + " IS NULL", args, err}
+	}
+	return compare(col, "=", v)
+}
+
+func Like(col, pattern string) Filter { return compare(col, "LIKE", pattern) }
+
+func Between(col string, lo, hi any) Filter {
+	c, args, err := column(col)
+	return Filter{c + " BETWEEN ? AND ?", append(args, lo, hi), err}
+}
+
+func In[V any](col string, vs ...V) Filter {
+	c, args, err := column(col)
+	if len(vs) == 0 {
+		return Filter{"0", nil, err}
+	}
+	for _, v := range vs {
+		args = append(args, v)
+	}
+	return Filter{c + " IN (?" + strings.Repeat(", ?", len(vs)-1) + ")", args, err}
+}
+
+// Has matches rows whose JSON array col (or path) contains v
+func Has(col string, v any) Filter {
+	c, args, err := column(col)
+	return Filter{"EXISTS (SELECT 1 FROM json_each(" + c + ") WHERE value = ?)", append(args, v), err}
+}
+
+func And(fs ...Filter) Filter { return join(" AND ", "1", fs) }
+
+func Or(fs ...Filter) Filter { return join(" OR ", "0", fs) }
+
+func Not(f Filter) Filter { return Filter{"NOT (" + f.sql + ")", f.args, f.err} }
+
+// Find returns the rows matching all filters (see Selection)
+func (t *Table[T]) Find(fs ...Filter) *Selection[T] {
+	return &Selection[T]{t: t, where: And(fs...)}
+}
+
+// OrderBy orders by cols; "-Col" orders descending
+func (s *Selection[T]) OrderBy(cols ...string) *Selection[T] {
+	s.order = cols
+	return s
+}
+
+func (s *Selection[T]) Limit(n int) *Selection[T] {
+	s.limit = n
+	return s
+}
+
+func (s *Selection[T]) Offset(n int) *Selection[T] {
+	s.offset = n
+	return s
+}
+
+// After continues (keyset pagination) after the row with the values vs of the OrderBy cols.
+// The order has to be unique, e.g. end with the id col, and its values must not be NULL.
+func (s *Selection[T]) After(vs ...any) *Selection[T] {
+	s.after = vs
+	return s
+}
+
+func (s *Selection[T]) All(ctx context.Context) ([]T, error) {
+	vs := []T{}
+	for v, err := range s.Iter(ctx) {
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, v)
+	}
+	return vs, nil
+}
+
+func (s *Selection[T]) Iter(ctx context.Context) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		q, args, err := s.query("SELECT *", true)
+		if err != nil {
+			yield(*new(T), err)
+			return
+		}
+		err = QueryRowsContext(ctx, s.t.conn(), q, func(v T) error {
+			if !yield(v, nil) {
+				return ErrAbortScan
+			}
+			return nil
+		}, args...)
+		if err != nil {
+			yield(*new(T), err)
+		}
+	}
+}
+
+func (s *Selection[T]) Count(ctx context.Context) (int, error) {
+	q, args, err := s.query("SELECT count(1)", false)
+	if err != nil {
+		return 0, err
+	}
+	return QueryOneContext[int](ctx, s.t.conn(), q, args...)
+}
+
+// Delete deletes the matching rows and returns their number. Order and limit are not supported.
+func (s *Selection[T]) Delete(ctx context.Context) (int64, error) {
+	if len(s.order) != 0 || s.limit != 0 || s.offset != 0 {
+		return 0, errors.New("delete does not support order, limit and offset")
+	}
+	q, args, err := s.query("DELETE", true)
+	if err != nil {
+		return 0, err
+	}
+	_, n, err := ExecContext(ctx, s.t.conn(), q, args...)
+	return n, err
+}
+
+// query returns verb with the where clause of s - and, if paged, its order, limit and offset
+func (s *Selection[T]) query(verb string, paged bool) (string, []any, error) {
+	table, err := Args{}.ident(s.t.name)
+	if err != nil {
+		return "", nil, err
+	}
+	where, after, order, orderArgs := []Filter{s.where}, []Filter{}, []string{}, []any{}
+	if len(s.after) != 0 && len(s.after) != len(s.order) {
+		return "", nil, fmt.Errorf("after: expected %d values for %v, got %d", len(s.order), s.order, len(s.after))
+	}
+	for i, v := range s.after {
+		if rv := reflect.ValueOf(v); v == nil || rv.Kind() == reflect.Pointer && rv.IsNil() {
+			return "", nil, fmt.Errorf("after: value of %s must not be nil", s.order[i])
+		}
+	}
+	for i, col := range s.order {
+		col, dir, op := strings.TrimPrefix(col, "-"), "ASC", ">"
+		if strings.HasPrefix(s.order[i], "-") {
+			dir, op = "DESC", "<"
+		}
+		c, args, err := column(col)
+		if err != nil {
+			return "", nil, err
+		}
+		order, orderArgs = append(order, c+" "+dir), append(orderArgs, args...)
+		if len(s.after) != 0 {
+			eqs := []Filter{}
+			for j := range i {
+				eqs = append(eqs, Eq(strings.TrimPrefix(s.order[j], "-"), s.after[j]))
+			}
+			after = append(after, And(append(eqs, Filter{c + " " + op + " ?", append(args, s.after[i]), nil})...))
+		}
+	}
+	if len(after) != 0 {
+		where = append(where, Or(after...))
+	}
+	w := And(where...)
+	if w.err != nil {
+		return "", nil, w.err
+	}
+	q := verb + " FROM " + table + " WHERE " + w.sql
+	if !paged {
+		return q, w.args, nil
+	} else if len(order) != 0 {
+		q += " ORDER BY " + strings.Join(order, ", ")
+	}
+	if s.limit != 0 || s.offset != 0 {
+		q += fmt.Sprintf(" LIMIT %d OFFSET %d", cmp.Or(s.limit, -1), s.offset)
+	}
+	return q, append(w.args, orderArgs...), nil
+}
+
+func (t *Table[T]) Upsert(v T, conflict ...string) (int64, error) {
+	return t.UpsertContext(context.Background(), v, conflict...)
+}
+
+// UpsertContext inserts v or, if it conflicts on the conflict cols (default: the id col), updates all other
+// cols of the existing row. It returns the rowid of the row.
+func (t *Table[T]) UpsertContext(ctx context.Context, v T, conflict ...string) (int64, error) {
+	idK, idV, kvs := RowMap(v)
+	if len(conflict) == 0 && idK == "" {
+		return 0, fmt.Errorf("upsert requires conflict cols for %T without id", v)
+	} else if len(conflict) == 0 {
+		conflict = []string{idK}
+	}
+	isConflict := func(k string) bool {
+		return slices.ContainsFunc(conflict, func(c string) bool { return strings.EqualFold(c, k) })
+	}
+	if idK != "" && !reflect.ValueOf(idV).IsZero() {
+		kvs[idK] = idV
+	}
+	table, err := Args{}.ident(t.name)
+	if err != nil {
+		return 0, err
+	}
+	cols, qs, sets, cs, args := []string{}, []string{}, []string{}, []string{}, []any{}
+	for _, k := range slices.Sorted(maps.Keys(kvs)) {
+		c, err := Args{}.ident(k)
+		if err != nil {
+			return 0, err
+		}
+		cols, qs, args = append(cols, c), append(qs, "?"), append(args, kvs[k])
+		if !isConflict(k) {
+			sets = append(sets, c+" = excluded."+c)
+		}
+	}
+	for _, k := range conflict {
+		c, err := Args{}.ident(k)
+		if err != nil {
+			return 0, err
+		}
+		cs = append(cs, c)
+	}
+	if len(sets) == 0 {
+		sets = append(sets, cs[0]+" = excluded."+cs[0]) // no-op update so RETURNING yields the existing row
+	}
+	action := "DO UPDATE SET " + strings.Join(sets, ", ")
+	q := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) %s RETURNING rowid",
+		table, strings.Join(cols, ", "), strings.Join(qs, ", "), strings.Join(cs, ", "), action)
+	return QueryOneContext[int64](ctx, t.conn(), q, args...)
+}
+
+// column returns the sql expression for col: an identifier or json_extract for "Col->$.path"
+func column(col string) (string, []any, error) {
+	name, path, isPath := strings.Cut(col, "->")
+	c, err := Args{}.ident(name)
+	if isPath {
+		return "json_extract(" + c + ", ?)", []any{path}, err
+	}
+	return c, nil, err
+}
+
+func compare(col, op string, v any) Filter {
+	c, args, err := column(col)
+	return Filter{c + " " + op + " ?", append(args, v), err}
+}
+
+// join joins the filters fs with sep; empty filters (e.g. Filter{}) are skipped
+func join(sep, empty string, fs []Filter) Filter {
+	sqls, args, errs := []string{}, []any{}, []error{}
+	for _, f := range fs {
+		if errs = append(errs, f.err); f.sql != "" {
+			sqls, args = append(sqls, "("+f.sql+")"), append(args, f.args...)
+		}
+	}
+	if len(sqls) == 0 {
+		return Filter{empty, nil, errors.Join(errs...)}
+	}
+	return Filter{strings.Join(sqls, sep), args, errors.Join(errs...)}
+}
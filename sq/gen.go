@@ -0,0 +1,268 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"database/sql/driver"
+	"fmt"
+	"go/format"
+	"go/token"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+type genQuery struct {
+	Name, Kind, Type, Const, SQL, Pos string
+	Doc                               []string
+	Params, Cols                      []genField
+	Positional                        bool
+}
+
+type genField struct{ Name, Col, Type string }
+
+var genNameRe = regexp.MustCompile(`^--\s*name:\s*([A-Z][a-zA-Z0-9_]*)\s+:(one|many|exec)(?:\s+(\S+))?\s*$`)
+var genParamRe = regexp.MustCompile(`[:@$]([a-zA-Z_][a-zA-Z0-9_]*)`)
+var genInitialisms = map[string]bool{"id": true, "url": true, "uri": true, "json": true, "html": true, "sql": true}
+
+// Generate returns the source of package pkg with typed functions for the queries in the .sql files.
+// Each query starts with an annotation `-- name: ListApps :many` (or :one, :exec) optionally followed
+// by the Go result type (e.g. `-- name: CountApps :one int`); further comment lines become its doc.
+// The queries are prepared against an in-memory db with migrations applied and f (see New) registered,
+// i.e. queries that don't match the schema fail to generate. Result types are inferred from the declared
+// column types (expressions are `any`), named params (:name, @name, $name) are typed like the columns of
+// the same name and positional params (?) become variadic args.
+func Generate(pkg string, migrations []string, f func(c *sqlite3.SQLiteConn) error, files ...string) ([]byte, error) {
+	// a named in-memory db is shared by all connections of the pool; ":memory:" is one db per connection
+	ctx, uri := context.Background(), "file:sq-generate-"+rand.Text()+"?mode=memory&cache=shared"
+	db, err := New(uri, nil, f, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := db.MigrateContext(ctx, migrations); err != nil {
+		return nil, fmt.Errorf("failed to migrate: %w", err)
+	}
+	colTypes, err := genColTypes(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	qs, imports := []genQuery{}, map[string]bool{"context": true}
+	for _, file := range files {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		fqs, err := parseQueries(file, string(src))
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range fqs {
+			if err := rawConn(ctx, db.DB, func(c *sqlite3.SQLiteConn) error { return q.check(ctx, c, colTypes) }); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", q.Pos, q.Name, err)
+			} else if slices.ContainsFunc(qs, func(o genQuery) bool { return o.Name == q.Name }) {
+				return nil, fmt.Errorf("%s: duplicate query %s", q.Pos, q.Name)
+			}
+			if len(q.Params) != 0 {
+				imports["database/sql"] = true
+			}
+			for _, f := range append(q.Params, append(q.Cols, genField{Type: q.Type})...) {
+				if f.Type == "time.Time" {
+					imports["time"] = true
+				} else if f.Type == "jsontext.Value" {
+					imports["encoding/json/jsontext"] = true
+				}
+			}
+			qs = append(qs, q)
+		}
+	}
+	src := Template("generate", map[string]any{
+		"pkg":     pkg,
+		"imports": slices.Sorted(maps.Keys(imports)),
+		"queries": qs,
+	})
+	bs, err := format.Source([]byte(src))
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %w\n%s", err, src)
+	}
+	return bs, nil
+}
+
+func parseQueries(file, src string) ([]genQuery, error) {
+	qs, s := []genQuery{}, bufio.NewScanner(strings.NewReader(src))
+	for l := 1; s.Scan(); l++ {
+		line := strings.TrimSpace(s.Text())
+		if m := genNameRe.FindStringSubmatch(line); m != nil {
+			qs = append(qs, genQuery{Name: m[1], Kind: m[2], Type: m[3], Pos: fmt.Sprintf("%s:%d", file, l),
+				Const: strings.ToLower(m[1][:1]) + m[1][1:] + "SQL"})
+			continue
+		} else if strings.HasPrefix(line, "-- name:") {
+			return nil, fmt.Errorf("%s:%d: invalid annotation %q: expected `-- name: Name :one|:many|:exec [Type]`", file, l, line)
+		} else if len(qs) == 0 {
+			if line != "" && !strings.HasPrefix(line, "--") {
+				return nil, fmt.Errorf("%s:%d: query without `-- name:` annotation", file, l)
+			}
+			continue
+		}
+		if q := &qs[len(qs)-1]; q.SQL == "" && strings.HasPrefix(line, "--") {
+			q.Doc = append(q.Doc, strings.TrimSpace(strings.TrimPrefix(line, "--")))
+		} else if line != "" || q.SQL != "" {
+			q.SQL += s.Text() + "\n"
+		}
+	}
+	for i := range qs {
+		qs[i].SQL = strings.TrimSuffix(strings.TrimSpace(qs[i].SQL), ";")
+		if qs[i].SQL == "" {
+			return nil, fmt.Errorf("%s: empty query %s", qs[i].Pos, qs[i].Name)
+		}
+	}
+	return qs, s.Err()
+}
+
+// check prepares the query to validate it and infer its params and result cols
+func (q *genQuery) check(ctx context.Context, c *sqlite3.SQLiteConn, colTypes map[string]string) error {
+	s, err := c.Prepare(q.SQL)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	names := []string{}
+	for _, m := range genParamRe.FindAllStringSubmatch(sqlLiteralRe.ReplaceAllString(q.SQL, ""), -1) {
+		if !slices.Contains(names, m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	if n := s.NumInput(); len(names) != 0 && len(names) != n {
+		return fmt.Errorf("found %d named of %d params: named and positional params can't be mixed", len(names), n)
+	} else if len(names) == 0 && n != 0 {
+		q.Positional = true
+	}
+	for _, name := range names {
+		t, ok := colTypes[normalizedCol(name)]
+		if !ok {
+			t = "any"
+		}
+		q.Params = append(q.Params, genField{Name: genParamName(name), Col: name, Type: t})
+	}
+	if q.Kind == "exec" {
+		if q.Type != "" {
+			return fmt.Errorf("exec queries don't have a result type")
+		}
+		return nil
+	}
+	rows, err := s.(driver.StmtQueryContext).QueryContext(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	cols := rows.Columns()
+	if len(cols) == 0 {
+		return fmt.Errorf("%s query does not return any columns", q.Kind)
+	} else if q.Type != "" {
+		return nil
+	}
+	for i, col := range cols {
+		name := genFieldName(col)
+		if name == "" {
+			return fmt.Errorf("column %q is not a valid field name: use AS", col)
+		} else if slices.ContainsFunc(q.Cols, func(f genField) bool { return f.Name == name }) {
+			return fmt.Errorf("duplicate column %q", col)
+		}
+		t := genType(rows.(driver.RowsColumnTypeDatabaseTypeName).ColumnTypeDatabaseTypeName(i))
+		q.Cols = append(q.Cols, genField{Name: name, Col: col, Type: t})
+	}
+	if len(q.Cols) == 1 {
+		q.Type, q.Cols = q.Cols[0].Type, nil
+	} else {
+		q.Type = q.Name + "Row"
+	}
+	return nil
+}
+
+// genColTypes returns the Go types of all cols by normalized name; cols with conflicting types are `any`
+func genColTypes(ctx context.Context, c Connection) (map[string]string, error) {
+	cols, err := QueryContext[struct{ Name, Type string }](ctx, c, `
+      SELECT ti.name, ti.type FROM pragma_table_list tl, pragma_table_info(tl.name) ti
+      WHERE tl.type IN ('table', 'view') AND tl.name NOT LIKE 'sqlite_%' AND tl.name != '_migrations'
+        AND substr(tl.name, 1, 4) != '_sq_'`)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	for _, c := range cols {
+		k, t := normalizedCol(c.Name), genType(c.Type)
+		if v, ok := m[k]; ok && v != t {
+			t = "any"
+		}
+		m[k] = t
+	}
+	return m, nil
+}
+
+// genType maps declared column types (see https://www.sqlite.org/datatype3.html#affinity_name_examples)
+// to the Go types the driver scans them into
+func genType(decl string) string {
+	switch t := strings.ToUpper(decl); {
+	case t == "":
+		return "any"
+	case strings.Contains(t, "JSON"):
+		return "jsontext.Value"
+	case strings.Contains(t, "DATE") || strings.Contains(t, "TIME"):
+		return "time.Time"
+	case strings.Contains(t, "BOOL"):
+		return "bool"
+	case strings.Contains(t, "INT"):
+		return "int64"
+	case strings.Contains(t, "CHAR") || strings.Contains(t, "CLOB") || strings.Contains(t, "TEXT"):
+		return "string"
+	case strings.Contains(t, "BLOB"):
+		return "[]byte"
+	case strings.Contains(t, "REAL") || strings.Contains(t, "FLOA") || strings.Contains(t, "DOUB"):
+		return "float64"
+	}
+	return "any"
+}
+
+func genFieldName(col string) string {
+	name := ""
+	for _, part := range strings.Split(col, "_") {
+		if genInitialisms[strings.ToLower(part)] {
+			name += strings.ToUpper(part)
+		} else if part != "" {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	if !token.IsIdentifier(name) {
+		return ""
+	}
+	return name
+}
+
+func genParamName(name string) string {
+	first, rest, _ := strings.Cut(name, "_")
+	if genInitialisms[strings.ToLower(first)] {
+		name = strings.ToLower(first) + genFieldName(rest)
+	} else {
+		name = strings.ToLower(first[:1]) + first[1:] + genFieldName(rest)
+	}
+	if token.IsKeyword(name) || name == "ctx" || name == "c" {
+		return name + "_"
+	}
+	return name
+}
+
+func (q genQuery) Literal() string {
+	if strings.Contains(q.SQL, "`") {
+		return strconv.Quote(q.SQL)
+	}
+	return "`" + q.SQL + "`"
+}
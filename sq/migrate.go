@@ -0,0 +1,223 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Migration is a versioned schema change. Down reverts Up and is stored when Up is applied,
+// i.e. rollbacks use the Down of the applied version of a migration.
+type Migration struct {
+	Version  int
+	Name     string
+	Up, Down string
+}
+
+type MigrationStatus struct {
+	Version        int
+	Name, Checksum string
+	AppliedAt      time.Time // zero if pending
+	Modified       bool      // Up changed after it was applied
+	Missing        bool      // applied but no longer part of the migrations
+}
+
+// MigrationStep is a single step of a MigrationPlan; Down steps revert an applied migration.
+type MigrationStep struct {
+	Version   int
+	Name, SQL string
+	Down      bool
+}
+
+type MigrationPlan []MigrationStep
+
+// Latest makes MigrateTo apply all migrations
+const Latest = -1
+
+type appliedMigration struct {
+	Version              int
+	Name, Checksum, Down string
+	AppliedAt            time.Time
+}
+
+const migrationsSchema = `CREATE TABLE IF NOT EXISTS _sq_migrations (
+  version INTEGER PRIMARY KEY, name TEXT, checksum TEXT, down TEXT, applied_at TIMESTAMP)`
+
+func (m Migration) Checksum() string {
+	h := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(h[:])
+}
+
+// Status returns the status of all migrations in ms and of applied migrations missing from ms, ordered by version.
+func (db *DB) Status(ctx context.Context, ms []Migration) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	ss := []MigrationStatus{}
+	for _, m := range ms {
+		s := MigrationStatus{Version: m.Version, Name: m.Name, Checksum: m.Checksum()}
+		if a, ok := applied[m.Version]; ok {
+			s.AppliedAt, s.Modified = a.AppliedAt, a.Checksum != s.Checksum
+		}
+		ss = append(ss, s)
+	}
+	for _, a := range applied {
+		if !slices.ContainsFunc(ms, func(m Migration) bool { return m.Version == a.Version }) {
+			ss = append(ss, MigrationStatus{a.Version, a.Name, a.Checksum, a.AppliedAt, false, true})
+		}
+	}
+	slices.SortFunc(ss, func(a, b MigrationStatus) int { return a.Version - b.Version })
+	return ss, nil
+}
+
+// MigrateTo applies the pending migrations of ms up to version (Latest for all) and reverts the applied
+// migrations above it in a single transaction. With dryRun the plan is only returned.
+// Applied migrations up to version must not have been modified; those above it are reverted by their recorded down step.
+func (db *DB) MigrateTo(ctx context.Context, ms []Migration, version int, dryRun bool) (MigrationPlan, error) {
+	if err := validateMigrations(ms); err != nil {
+		return nil, err
+	}
+	return db.migrate(ctx, ms, dryRun, func(applied map[int]appliedMigration) (MigrationPlan, error) {
+		plan := MigrationPlan{}
+		for _, a := range appliedDesc(applied) {
+			if version != Latest && a.Version > version {
+				plan = append(plan, MigrationStep{a.Version, a.Name, a.Down, true})
+			}
+		}
+		for _, m := range ms {
+			if a, ok := applied[m.Version]; ok && (version == Latest || m.Version <= version) && a.Checksum != m.Checksum() {
+				return nil, &MigrateError{Reason: "checksum", Details: fmt.Sprintf("migration %d (%s) was modified after it was applied", m.Version, m.Name)}
+			} else if !ok && (version == Latest || m.Version <= version) {
+				plan = append(plan, MigrationStep{m.Version, m.Name, m.Up, false})
+			}
+		}
+		return plan, nil
+	})
+}
+
+// NewVersioned is New with versioned migrations: ms are applied up to Latest (see MigrateTo).
+// To move from the compatibility mode, pass the old statements to New and call MigrateTo afterwards;
+// both modes track their state separately (_migrations and _sq_migrations).
+func NewVersioned(uri string, ms []Migration, f func(c *sqlite3.SQLiteConn) error) (*DB, error) {
+	db, err := New(uri, nil, f, 0)
+	if err != nil {
+		return nil, err
+	} else if _, err := db.MigrateTo(context.Background(), ms, Latest, false); err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	return db, nil
+}
+
+// Rollback reverts the last n applied migrations. With dryRun the plan is only returned.
+func (db *DB) Rollback(ctx context.Context, n int, dryRun bool) (MigrationPlan, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("rollback: n must not be negative: %d", n)
+	} else if n == 0 {
+		return MigrationPlan{}, nil
+	}
+	return db.migrate(ctx, nil, dryRun, func(applied map[int]appliedMigration) (MigrationPlan, error) {
+		plan := MigrationPlan{}
+		for _, a := range appliedDesc(applied)[:min(n, len(applied))] {
+			plan = append(plan, MigrationStep{a.Version, a.Name, a.Down, true})
+		}
+		return plan, nil
+	})
+}
+
+// migrate applies the plan f returns for the applied migrations; ms are the migrations recorded for up steps
+func (db *DB) migrate(ctx context.Context, ms []Migration, dryRun bool, f func(map[int]appliedMigration) (MigrationPlan, error)) (MigrationPlan, error) {
+	plan := MigrationPlan(nil)
+	err := db.TxImmediate(ctx, func(tx *Tx) error {
+		applied, err := appliedMigrations(ctx, tx)
+		if err != nil {
+			return err
+		} else if plan, err = f(applied); err != nil {
+			return err
+		}
+		for _, s := range plan {
+			if s.Down && strings.TrimSpace(s.SQL) == "" {
+				return &MigrateError{Reason: "irreversible", Details: fmt.Sprintf("migration %d (%s) has no down step", s.Version, s.Name)}
+			}
+		}
+		if dryRun {
+			return nil
+		}
+		for _, s := range plan {
+			if _, _, err := ExecContext(ctx, tx, s.SQL); err != nil {
+				return fmt.Errorf("failed to apply %s: %w", s.title(), err)
+			} else if s.Down {
+				_, _, err = ExecContext(ctx, tx, "DELETE FROM _sq_migrations WHERE version = ?", s.Version)
+			} else {
+				m := ms[slices.IndexFunc(ms, func(m Migration) bool { return m.Version == s.Version })]
+				_, _, err = ExecContext(ctx, tx, "INSERT INTO _sq_migrations VALUES (?, ?, ?, ?, ?)",
+					m.Version, m.Name, m.Checksum(), m.Down, time.Now().UTC())
+			}
+			if err != nil {
+				return fmt.Errorf("failed to record %s: %w", s.title(), err)
+			}
+		}
+		return nil
+	})
+	return plan, err
+}
+
+func appliedMigrations(ctx context.Context, c Connection) (map[int]appliedMigration, error) {
+	if _, _, err := ExecContext(ctx, c, migrationsSchema); err != nil {
+		return nil, fmt.Errorf("failed to create _sq_migrations table: %w", err)
+	}
+	as, err := QueryContext[appliedMigration](ctx, c, "SELECT * FROM _sq_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query _sq_migrations: %w", err)
+	}
+	m := map[int]appliedMigration{}
+	for _, a := range as {
+		m[a.Version] = a
+	}
+	return m, nil
+}
+
+func appliedDesc(applied map[int]appliedMigration) []appliedMigration {
+	as := []appliedMigration{}
+	for _, a := range applied {
+		as = append(as, a)
+	}
+	slices.SortFunc(as, func(a, b appliedMigration) int { return b.Version - a.Version })
+	return as
+}
+
+func validateMigrations(ms []Migration) error {
+	for i, m := range ms {
+		if m.Version <= 0 {
+			return fmt.Errorf("migration %q: version must be positive", m.Name)
+		} else if i > 0 && m.Version <= ms[i-1].Version {
+			return fmt.Errorf("migration %d (%s): versions must be strictly increasing", m.Version, m.Name)
+		}
+	}
+	return nil
+}
+
+func (s MigrationStep) title() string {
+	if s.Down {
+		return fmt.Sprintf("down %d %s", s.Version, s.Name)
+	}
+	return fmt.Sprintf("up %d %s", s.Version, s.Name)
+}
+
+// String returns the plan as an SQL script with a comment per step
+func (p MigrationPlan) String() string {
+	w := &strings.Builder{}
+	for _, s := range p {
+		fmt.Fprintf(w, "-- %s\n%s\n", s.title(), strings.TrimSpace(s.SQL))
+	}
+	return w.String()
+}
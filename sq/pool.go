@@ -0,0 +1,87 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var sqlLiteralRe = regexp.MustCompile(`'(?:[^']|'')*'|"(?:[^"]|"")*"|--[^\n]*|/\*(?:.|\n)*?\*/`)
+
+// SplitReads switches the db to WAL mode and splits it into a pool of up to n read-only connections
+// and a single write connection (the embedded *sql.DB). SELECT queries (also with WITH clauses) and backups
+// go to the readers, everything else (ExecContext, INSERT ... RETURNING, transactions, ...) to the writer.
+// Writers queue for the connection rather than failing with SQLITE_BUSY. As a Tx holds the write connection,
+// calling db.Tx or writing through the db (rather than the Tx) inside a Tx callback deadlocks.
+func (db *DB) SplitReads(n int) error {
+	if db.reader != nil {
+		return errors.New("reads are already split")
+	} else if name, _, _ := strings.Cut(db.uri, "?"); name == "" || strings.Contains(db.uri, ":memory:") ||
+		strings.Contains(db.uri, "mode=memory") {
+		return fmt.Errorf("split reads requires a db file: %q", db.uri)
+	}
+	if mode, err := QueryOneContext[string](context.Background(), db.DB, "PRAGMA journal_mode = WAL"); err != nil {
+		return err
+	} else if mode != "wal" {
+		return fmt.Errorf("split reads requires WAL mode: got %q", mode)
+	}
+	sep := "?"
+	if strings.Contains(db.uri, "?") {
+		sep = "&"
+	}
+	reader, err := sql.Open(db.driver, db.uri+sep+"_query_only=true")
+	if err != nil {
+		return fmt.Errorf("failed to open readers: %w", err)
+	}
+	reader.SetMaxOpenConns(n)
+	db.DB.SetMaxOpenConns(1)
+	db.reader = reader
+	return nil
+}
+
+// QueryContext runs SELECT queries on the readers (see SplitReads) and everything else on the writer
+func (db *DB) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	if db.reader != nil && isSelect(query) {
+		return db.reader.QueryContext(ctx, query, args...)
+	}
+	return db.DB.QueryContext(ctx, query, args...)
+}
+
+func (db *DB) Close() error {
+	if db.reader == nil {
+		return db.DB.Close()
+	}
+	return errors.Join(db.reader.Close(), db.DB.Close())
+}
+
+// isSelect returns whether query is a SELECT (or VALUES), optionally with a WITH clause
+func isSelect(query string) bool {
+	depth, top := 0, &strings.Builder{}
+	for _, r := range sqlLiteralRe.ReplaceAllString(query, " ") {
+		if r == '(' {
+			depth++
+		} else if r == ')' {
+			depth--
+		} else if depth == 0 {
+			top.WriteRune(r)
+		}
+	}
+	ws := strings.Fields(strings.ToUpper(top.String()))
+	if len(ws) == 0 || ws[0] != "SELECT" && ws[0] != "VALUES" && ws[0] != "WITH" {
+		return false
+	}
+	for _, w := range ws {
+		switch w {
+		case "SELECT", "VALUES":
+			return true
+		case "INSERT", "REPLACE", "UPDATE", "DELETE":
+			return false
+		}
+	}
+	return false
+}
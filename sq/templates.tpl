@@ -30,7 +30,7 @@ END;
 
 {{ define "schema" }}
 {{ $t := . }}
-CREATE TABLE IF NOT EXISTS {{ $t.name }}s (
+CREATE TABLE IF NOT EXISTS {{ $t.name }} (
   {{- range $i, $f := $t.fields }}
     {{ if $i }}, {{ end }}
       {{- $f.Name }} {{ $f.Kind }} {{ $f.Extra }}
@@ -44,16 +44,55 @@ CREATE TABLE IF NOT EXISTS {{ $t.name }}s (
 
 {{define "schema-field-default"}}
 {{ if eq .on "create" }}
-CREATE TRIGGER {{ .table }}_{{ .field }}_default_ai AFTER INSERT ON {{ .table }}s
+CREATE TRIGGER {{ .type }}_{{ .field }}_default_ai AFTER INSERT ON {{ .table }}
 WHEN NEW.{{ .field }} = {{ .when }} OR NEW.{{ .field }} IS NULL
-BEGIN UPDATE {{ .table }}s SET {{ .field }} = {{ .default }} WHERE rowid = NEW.rowid; END;
-CREATE TRIGGER {{ .table }}_{{ .field }}_default_au AFTER UPDATE ON {{ .table }}s
+BEGIN UPDATE {{ .table }} SET {{ .field }} = {{ .default }} WHERE rowid = NEW.rowid; END;
+CREATE TRIGGER {{ .type }}_{{ .field }}_default_au AFTER UPDATE ON {{ .table }}
 WHEN NEW.{{ .field }} = {{ .when }}
-BEGIN UPDATE {{ .table }}s SET {{ .field }} = OLD.{{ .field }} WHERE rowid = NEW.rowid; END;
+BEGIN UPDATE {{ .table }} SET {{ .field }} = OLD.{{ .field }} WHERE rowid = NEW.rowid; END;
 {{ end }}
 {{ if eq .on "update" }}
-CREATE TRIGGER {{ .table }}_{{ .field }}_default_au AFTER UPDATE ON {{ .table }}s
+CREATE TRIGGER {{ .type }}_{{ .field }}_default_au AFTER UPDATE ON {{ .table }}
 WHEN NEW.{{ .field }} = {{ .when }} OR OLD.{{ .field }} IS NEW.{{ .field }}
-BEGIN UPDATE {{ .table }}s SET {{ .field }} = {{ .default }} WHERE rowid = NEW.rowid; END;
+BEGIN UPDATE {{ .table }} SET {{ .field }} = {{ .default }} WHERE rowid = NEW.rowid; END;
+{{ end }}
+{{ end }}
+
+
+{{ define "generate" }}
+// Code generated by sq.Generate. DO NOT EDIT.
+
+package {{ .pkg }}
+
+import (
+{{- range .imports }}
+  "{{ . }}"
+{{- end }}
+
+  "github.com/niklasfasching/x/sq"
+)
+{{ range .queries }}
+const {{ .Const }} = {{ .Literal }}
+{{ if .Cols }}
+type {{ .Type }} struct {
+{{- range .Cols }}
+  {{ .Name }} {{ .Type }}
+{{- end }}
+}
+{{ end }}
+{{- range .Doc }}
+// {{ . }}
+{{- end }}
+func {{ .Name }}(ctx context.Context, c sq.Connection
+  {{- range .Params }}, {{ .Name }} {{ .Type }}{{ end }}{{ if .Positional }}, args ...any{{ end }})
+  {{- if eq .Kind "exec" }} (int64, int64, error) {
+  return sq.ExecContext(ctx, c, {{ .Const }}
+  {{- else if eq .Kind "one" }} ({{ .Type }}, error) {
+  return sq.QueryOneContext[{{ .Type }}](ctx, c, {{ .Const }}
+  {{- else }} ([]{{ .Type }}, error) {
+  return sq.QueryContext[{{ .Type }}](ctx, c, {{ .Const }}
+  {{- end }}
+  {{- range .Params }}, sql.Named({{ printf "%q" .Col }}, {{ .Name }}){{ end }}{{ if .Positional }}, args...{{ end }})
+}
 {{ end }}
 {{ end }}
@@ -0,0 +1,126 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Tx is a transaction on a single connection of a DB; see DB.Tx. It's a Connection and Tables can
+// be used inside it via Table.In.
+type Tx struct {
+	c          *sql.Conn
+	savepoints int
+}
+
+// TxRetries is the number of times Tx retries a transaction that failed with SQLITE_BUSY (or SQLITE_LOCKED)
+var TxRetries = 5
+
+// TxBackoff is the time Tx waits before the first retry; it doubles with each retry
+var TxBackoff = 10 * time.Millisecond
+
+// Tx runs f in a transaction (BEGIN DEFERRED) that is committed if f returns nil and rolled back if f
+// returns an error or panics. Transactions failing because the db is busy are retried, i.e. f must not have
+// side effects outside of the transaction.
+func (db *DB) Tx(ctx context.Context, f func(*Tx) error) error {
+	return db.tx(ctx, "BEGIN", f)
+}
+
+// TxImmediate is Tx for writers: BEGIN IMMEDIATE acquires the write lock upfront instead of failing
+// with SQLITE_BUSY when a read transaction is upgraded.
+func (db *DB) TxImmediate(ctx context.Context, f func(*Tx) error) error {
+	return db.tx(ctx, "BEGIN IMMEDIATE", f)
+}
+
+func (db *DB) tx(ctx context.Context, begin string, f func(*Tx) error) error {
+	for i := 0; ; i++ {
+		err := db.tryTx(ctx, begin, f)
+		if i >= TxRetries || !IsBusy(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(TxBackoff << i):
+		}
+	}
+}
+
+func (db *DB) tryTx(ctx context.Context, begin string, f func(*Tx) error) error {
+	c, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer release(c)
+	if _, err := c.ExecContext(ctx, begin); err != nil {
+		return err
+	}
+	return (&Tx{c: c}).run(ctx, "COMMIT", "ROLLBACK", f)
+}
+
+// Tx runs f in a nested transaction (SAVEPOINT) that is released if f returns nil and rolled back if f
+// returns an error or panics. The outer transaction is not affected by the rollback.
+func (tx *Tx) Tx(ctx context.Context, f func(*Tx) error) error {
+	tx.savepoints++
+	defer func() { tx.savepoints-- }()
+	name := fmt.Sprintf("sq_savepoint_%d", tx.savepoints)
+	if _, err := tx.c.ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	return tx.run(ctx, "RELEASE "+name, "ROLLBACK TO "+name+"; RELEASE "+name, f)
+}
+
+func (tx *Tx) run(ctx context.Context, commit, rollback string, f func(*Tx) error) error {
+	defer func() {
+		if r := recover(); r != nil {
+			tx.c.ExecContext(context.WithoutCancel(ctx), rollback)
+			panic(r)
+		}
+	}()
+	err := f(tx)
+	if err == nil {
+		if _, err = tx.c.ExecContext(ctx, commit); err == nil {
+			return nil
+		}
+	}
+	if _, rErr := tx.c.ExecContext(context.WithoutCancel(ctx), rollback); rErr != nil {
+		return errors.Join(err, fmt.Errorf("failed to rollback: %w", rErr))
+	}
+	return err
+}
+
+// release returns c to the pool - or closes it if it's still in a transaction, e.g. because both
+// COMMIT and ROLLBACK failed, so the transaction does not leak into the next use of the connection
+func release(c *sql.Conn) error {
+	err := c.Raw(func(dc any) error {
+		if sc, ok := dc.(*sqlite3.SQLiteConn); ok && !sc.AutoCommit() {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	if errors.Is(err, driver.ErrBadConn) {
+		return nil // Raw closed c
+	}
+	return c.Close()
+}
+
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return tx.c.QueryContext(ctx, query, args...)
+}
+
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return tx.c.ExecContext(ctx, query, args...)
+}
+
+// IsBusy returns whether err is caused by a locked db (SQLITE_BUSY or SQLITE_LOCKED)
+func IsBusy(err error) bool {
+	e := sqlite3.Error{}
+	return errors.As(err, &e) && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+}
@@ -69,7 +69,8 @@ func Schema(v any, rest ...string) string {
 			if on, ok := auto[f.Name]; ok && extra == "AUTO" {
 				extra, raw = "", raw+Template("schema-field-default", map[string]any{
 					"on":      on,
-					"table":   t.Name(),
+					"type":    t.Name(),
+					"table":   tableName(t),
 					"field":   f.Name,
 					"when":    "'0001-01-01 00:00:00+00:00'",
 					"default": "CURRENT_TIMESTAMP",
@@ -84,7 +85,7 @@ func Schema(v any, rest ...string) string {
 		fields = append(fields, field{f.Name, kind, fallback, extra})
 	}
 	return Template("schema", map[string]any{
-		"name":   t.Name(),
+		"name":   tableName(t),
 		"pk":     pk,
 		"fields": fields,
 		"rest":   strings.Join(rest, ", "),
@@ -92,6 +93,11 @@ func Schema(v any, rest ...string) string {
 	})
 }
 
+// tableName returns the name of the table Schema creates for struct type t
+func tableName(t reflect.Type) string {
+	return t.Name() + "s"
+}
+
 func RowMap[T any](v T) (string, any, map[string]any) {
 	rv, t := reflect.ValueOf(v), reflect.TypeOf(v)
 	if t.Kind() == reflect.Pointer {
@@ -116,7 +122,7 @@ func RowMap[T any](v T) (string, any, map[string]any) {
 func Tables(c Connection, caseInsensitive bool) (map[string][]string, error) {
 	sql := `SELECT name, (SELECT group_concat(name) FROM pragma_table_info(tl.name)) as columns
             FROM pragma_table_list tl
-            WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != '_migrations'`
+            WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != '_migrations' AND substr(name, 1, 4) != '_sq_'`
 	ts, err := QueryMapContext[string](context.Background(), c, sql)
 	m := map[string][]string{}
 	for _, t := range ts {
@@ -144,61 +150,55 @@ func CopyContext(ctx context.Context, name string, oldDB, newDB *DB, requireForw
 	if err := oldDB.Close(); err != nil {
 		return fmt.Errorf("failed to close old db: %w", err)
 	}
-	newTX, err := newDB.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to open rebuild tx: %w", err)
-	}
-	defer newTX.Rollback()
-	newTables, err := Tables(newDB, true)
-	if err != nil {
-		return fmt.Errorf("failed to list tables to rebuild: %w", err)
-	}
-	if requireForwardOnly {
-		dropped := []string{}
-		for table := range oldTables {
-			if _, ok := newTables[table]; !ok {
-				dropped = append(dropped, fmt.Sprintf("table %q", table))
-			}
+	return newDB.Tx(ctx, func(newTX *Tx) error {
+		newTables, err := Tables(newTX, true)
+		if err != nil {
+			return fmt.Errorf("failed to list tables to rebuild: %w", err)
 		}
-		for table, oldCols := range oldTables {
-			for _, col := range oldCols {
-				if !slices.Contains(newTables[table], col) {
-					dropped = append(dropped, fmt.Sprintf("column %q.%q", table, col))
+		if requireForwardOnly {
+			dropped := []string{}
+			for table := range oldTables {
+				if _, ok := newTables[table]; !ok {
+					dropped = append(dropped, fmt.Sprintf("table %q", table))
 				}
 			}
-		}
-		if len(dropped) > 0 {
-			return &MigrateError{
-				Reason:    "forward_only",
-				Details:   fmt.Sprintf("Would drop: %s", strings.Join(dropped, ", ")),
-				OldTables: oldTables,
+			for table, oldCols := range oldTables {
+				for _, col := range oldCols {
+					if !slices.Contains(newTables[table], col) {
+						dropped = append(dropped, fmt.Sprintf("column %q.%q", table, col))
+					}
+				}
+			}
+			if len(dropped) > 0 {
+				return &MigrateError{
+					Reason:    "forward_only",
+					Details:   fmt.Sprintf("Would drop: %s", strings.Join(dropped, ", ")),
+					OldTables: oldTables,
+				}
 			}
 		}
-	}
-	if _, _, err := ExecContext(ctx, newTX, fmt.Sprintf("ATTACH DATABASE '%s' AS old", name)); err != nil {
-		return fmt.Errorf("failed to attach existing db: %w", err)
-	}
-	for name, oldCols := range oldTables {
-		newCols := newTables[name]
-		if len(newCols) == 0 {
-			continue
+		if _, _, err := ExecContext(ctx, newTX, fmt.Sprintf("ATTACH DATABASE '%s' AS old", name)); err != nil {
+			return fmt.Errorf("failed to attach existing db: %w", err)
 		}
-		cols := []string{}
-		for _, c := range newCols {
-			if slices.Contains(oldCols, c) {
-				cols = append(cols, c)
+		for name, oldCols := range oldTables {
+			newCols := newTables[name]
+			if len(newCols) == 0 {
+				continue
+			}
+			cols := []string{}
+			for _, c := range newCols {
+				if slices.Contains(oldCols, c) {
+					cols = append(cols, c)
+				}
+			}
+			sql := fmt.Sprintf(`INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM old.%[1]s`,
+				name, strings.Join(cols, ","))
+			if _, _, err := ExecContext(ctx, newTX, sql); err != nil {
+				return fmt.Errorf("failed to copy data from table %q: %w", name, err)
 			}
 		}
-		sql := fmt.Sprintf(`INSERT INTO %[1]s (%[2]s) SELECT %[2]s FROM old.%[1]s`,
-			name, strings.Join(cols, ","))
-		if _, _, err := ExecContext(ctx, newTX, sql); err != nil {
-			return fmt.Errorf("failed to copy data from table %q: %w", name, err)
-		}
-	}
-	if err := newTX.Commit(); err != nil {
-		return fmt.Errorf("failed to commit rebuild tx: %w", err)
-	}
-	return nil
+		return nil
+	})
 }
 
 func FTSIndex(name, table, id, tokenizer string, cols ...string) string {
@@ -312,6 +312,8 @@ func (v *JSON) Scan(src any) error {
 func (e *MigrateError) Error() string {
 	if e.Reason == "rebuild" {
 		return "schema needs to be rebuilt"
+	} else if e.Reason == "checksum" || e.Reason == "irreversible" {
+		return "Migration Blocked: " + e.Details
 	}
 	return "Schema Change Blocked: " + e.Details
 }
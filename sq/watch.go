@@ -0,0 +1,187 @@
+//go:build goexperiment.jsonv2
+
+package sq
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Change is an insert, update or delete of a row recorded in the _sq_changes table.
+// Err is set on the last Change of a Watch that failed.
+type Change struct {
+	ID       int64 // cursor to resume from (see WatchFrom)
+	Table    string
+	Op       string // INSERT, UPDATE or DELETE
+	RowID    int64
+	Old, New map[string]any
+	At       time.Time
+	Err      error
+}
+
+// WatchInterval is the interval at which Watch polls for new changes
+var WatchInterval = 250 * time.Millisecond
+
+// WatchBatchSize is the maximum number of changes Watch reads per query
+var WatchBatchSize = 1000
+
+const changesSchema = `CREATE TABLE IF NOT EXISTS _sq_changes (
+  id INTEGER PRIMARY KEY AUTOINCREMENT, tbl TEXT, op TEXT, row_id INTEGER,
+  old JSON_TEXT, new JSON_TEXT, at TIMESTAMP DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX IF NOT EXISTS _sq_changes_tbl ON _sq_changes (tbl, id);`
+
+// Watch is WatchFrom the current end of the changelog
+func Watch(ctx context.Context, db *DB, tables ...string) iter.Seq[Change] {
+	return WatchFrom(ctx, db, -1, tables...)
+}
+
+// WatchFrom yields the changes of the rowid tables after cursor (-1 for the current end) until ctx is done.
+// Changes are recorded by triggers that are (re)created for the current columns of tables; they persist,
+// i.e. consumers can resume from the ID of the last change they processed after a restart.
+// Tables that are rebuilt (e.g. by Diff or New) have to be watched again to record changes.
+func WatchFrom(ctx context.Context, db *DB, cursor int64, tables ...string) iter.Seq[Change] {
+	return func(yield func(Change) bool) {
+		if err := TrackChanges(ctx, db, tables...); err != nil {
+			yield(Change{Err: err})
+			return
+		}
+		q, args := changesQuery(tables)
+		if cursor < 0 {
+			id, err := QueryOneContext[int64](ctx, db, "SELECT coalesce(max(id), 0) FROM _sq_changes")
+			if err != nil {
+				yield(Change{Err: err})
+				return
+			}
+			cursor = id
+		}
+		ticker := time.NewTicker(WatchInterval)
+		defer ticker.Stop()
+		for {
+			cs, err := QueryContext[Change](ctx, db, q, append([]any{cursor}, args...)...)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				yield(Change{Err: fmt.Errorf("failed to query changes: %w", err)})
+				return
+			}
+			for _, c := range cs {
+				if !yield(c) {
+					return
+				}
+				cursor = c.ID
+			}
+			if len(cs) == WatchBatchSize {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// TrackChanges (re)creates the triggers that record changes of tables in _sq_changes
+func TrackChanges(ctx context.Context, db *DB, tables ...string) error {
+	return db.TxImmediate(ctx, func(tx *Tx) error {
+		if _, _, err := ExecContext(ctx, tx, changesSchema); err != nil {
+			return fmt.Errorf("failed to create _sq_changes table: %w", err)
+		}
+		for _, table := range tables {
+			cols, err := QueryMapContext[string](ctx, tx, "SELECT name, type FROM pragma_table_info(?)", table)
+			if err != nil {
+				return fmt.Errorf("failed to list columns of %q: %w", table, err)
+			} else if len(cols) == 0 {
+				return fmt.Errorf("failed to track changes: table %q not found", table)
+			}
+			for _, op := range []string{"INSERT", "UPDATE", "DELETE"} {
+				name, err := Args{}.ident("_sq_changes_" + table + "_" + strings.ToLower(op))
+				if err != nil {
+					return err
+				}
+				stmt, err := changesTrigger(name, table, op, cols)
+				if err != nil {
+					return err
+				} else if _, _, err := ExecContext(ctx, tx, "DROP TRIGGER IF EXISTS "+name); err != nil {
+					return fmt.Errorf("failed to drop trigger %s: %w", name, err)
+				} else if _, _, err := ExecContext(ctx, tx, stmt); err != nil {
+					return fmt.Errorf("failed to create trigger %s: %w", name, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// PruneChanges deletes the recorded changes up to and including cursor
+func PruneChanges(ctx context.Context, c Connection, cursor int64) error {
+	_, _, err := ExecContext(ctx, c, "DELETE FROM _sq_changes WHERE id <= ?", cursor)
+	return err
+}
+
+func changesTrigger(name, table, op string, cols []map[string]string) (string, error) {
+	t, err := Args{}.ident(table)
+	if err != nil {
+		return "", err
+	}
+	// sqlite functions take at most 127 args, i.e. wide rows are built as json_object of the first
+	// cols and json_insert of the rest in chunks (json_patch would drop NULL values)
+	row := func(prefix string) (string, error) {
+		obj := ""
+		for cs := range slices.Chunk(cols, 63) {
+			kvs := []string{}
+			for _, c := range cs {
+				col, err := Args{}.ident(c["name"])
+				if err != nil {
+					return "", err
+				}
+				k, v := fmt.Sprintf(`'$."%s"'`, c["name"]), prefix+"."+col
+				if obj == "" {
+					k = "'" + c["name"] + "'"
+				}
+				if c["type"] == "JSON_TEXT" {
+					v = "json(" + v + ")"
+				}
+				kvs = append(kvs, k+", "+v)
+			}
+			if obj == "" {
+				obj = "json_object(" + strings.Join(kvs, ", ") + ")"
+			} else {
+				obj = "json_insert(" + obj + ", " + strings.Join(kvs, ", ") + ")"
+			}
+		}
+		return obj, nil
+	}
+	oldRow, newRow, rowid := "NULL", "NULL", "NEW.rowid"
+	if op != "INSERT" {
+		if oldRow, err = row("OLD"); err != nil {
+			return "", err
+		}
+	}
+	if op != "DELETE" {
+		if newRow, err = row("NEW"); err != nil {
+			return "", err
+		}
+	} else {
+		rowid = "OLD.rowid"
+	}
+	return fmt.Sprintf(`CREATE TRIGGER %s AFTER %s ON %s BEGIN
+  INSERT INTO _sq_changes (tbl, op, row_id, old, new) VALUES ('%s', '%s', %s, %s, %s);
+END`, name, op, t, table, op, rowid, oldRow, newRow), nil
+}
+
+func changesQuery(tables []string) (string, []any) {
+	q, args := `SELECT id, tbl AS "table", op, row_id, old, new, at FROM _sq_changes WHERE id > ?`, []any{}
+	if len(tables) != 0 {
+		q += " AND tbl IN (?" + strings.Repeat(", ?", len(tables)-1) + ")"
+		for _, t := range tables {
+			args = append(args, t)
+		}
+	}
+	return q + fmt.Sprintf(" ORDER BY id LIMIT %d", WatchBatchSize), args
+}
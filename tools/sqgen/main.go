@@ -0,0 +1,40 @@
+//go:build goexperiment.jsonv2
+
+// USAGE:
+// //go:generate go run github.com/niklasfasching/x/tools/sqgen generate --schema schema.sql --package db --out queries.go queries.sql
+
+package main
+
+import (
+	"os"
+
+	"github.com/niklasfasching/x/cli"
+	"github.com/niklasfasching/x/sq"
+)
+
+type flags struct {
+	Schema  []string `cli:"migration files applied in order before the queries are prepared::::required"`
+	Package string   `cli:"package name of the generated file::::required"`
+	Out     string   `cli:"generated file::queries.go"`
+}
+
+func main() {
+	cli.API{
+		"generate": {Desc: "generate typed query functions from annotated .sql files (see sq.Generate)",
+			F: func(cmd string, a struct{ Files []string }, f flags) error {
+				migrations := []string{}
+				for _, file := range f.Schema {
+					bs, err := os.ReadFile(file)
+					if err != nil {
+						return err
+					}
+					migrations = append(migrations, string(bs))
+				}
+				src, err := sq.Generate(f.Package, migrations, sq.FuncHook(nil), a.Files...)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(f.Out, src, 0644)
+			}},
+	}.Main()
+}